@@ -1,14 +1,24 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"log"
+	"os"
 
 	"github.com/tjs-w/go-proto-stomp/pkg/stomp"
 )
 
 func main() {
 	transport := flag.String("t", "websocket", "transport for STOMP (tcp, websocket)")
+	storePath := flag.String("s", "", "file to persist the queued messages in (no persistence if empty)")
+	certFile := flag.String("cert", "", "TLS certificate file (no TLS if empty)")
+	keyFile := flag.String("key", "", "TLS private key file")
+	caFile := flag.String("ca", "", "CA certificates file to require and verify the client certificates (mutual TLS)")
+	authFile := flag.String("auth", "", "JSON file of the users and the destinations they may read and write "+
+		"(no authentication if empty)")
 	flag.Parse()
 	host := "localhost"
 	port := stomp.DefaultPort
@@ -25,17 +35,70 @@ func main() {
 	}
 
 	var err error
+	var store stomp.MessageStore
+	if *storePath != "" {
+		var fileStore *stomp.FileStore
+		if fileStore, err = stomp.NewFileStore(*storePath); err != nil {
+			log.Fatalln(err)
+		}
+		defer func() { _ = fileStore.Close() }()
+		store = fileStore
+	}
+
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		if tlsConfig, err = loadTLSConfig(*certFile, *keyFile, *caFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var loginFunc stomp.LoginFunc
+	var authorizer stomp.Authorizer
+	if *authFile != "" {
+		var fileAuth *stomp.FileAuthorizer
+		if fileAuth, err = stomp.NewFileAuthorizer(*authFile); err != nil {
+			log.Fatalln(err)
+		}
+		loginFunc, authorizer = fileAuth.Login, fileAuth
+	}
+
 	var broker stomp.Broker
 	if broker, err = stomp.StartBroker(&stomp.BrokerOpts{
 		Transport:                    t,
 		Host:                         host,
 		Port:                         port,
-		LoginFunc:                    nil,
+		LoginFunc:                    loginFunc,
+		Authorizer:                   authorizer,
 		HeartbeatSendIntervalMsec:    5000,
 		HeartbeatReceiveIntervalMsec: 5000,
+		MessageStore:                 store,
+		TLSConfig:                    tlsConfig,
 	}); err != nil {
 		log.Fatalln(err)
 	}
 	broker.ListenAndServe()
 	flag.Usage()
 }
+
+// loadTLSConfig builds the server TLS configuration, requiring the client certificates signed by the CA if given
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no CA certificates in " + caFile)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
@@ -386,7 +386,7 @@ func handleConnect(in []string) {
 		t = stomp.TransportWebsocket
 	}
 	setupConnection(in[1], in[2], t)
-	if err := ctx.client.Connect(false); err != nil {
+	if _, err := ctx.client.Connect(false); err != nil {
 		errorMsg(err.Error())
 		return
 	}
@@ -8,10 +8,10 @@ require (
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/deckarep/golang-set v1.8.0
 	github.com/fatih/color v1.13.0
-	github.com/go-co-op/gocron v1.13.0
 	github.com/google/go-cmp v0.5.8
 	github.com/google/uuid v1.3.0
 	github.com/jessevdk/go-flags v1.5.0
+	golang.org/x/crypto v0.9.0
 	nhooyr.io/websocket v1.8.7
 )
 
@@ -24,7 +24,6 @@ require (
 	github.com/mattn/go-tty v0.0.3 // indirect
 	github.com/mschoch/smat v0.2.0 // indirect
 	github.com/pkg/term v1.2.0-beta.2 // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	golang.org/x/sys v0.10.0 // indirect
 )
@@ -0,0 +1,131 @@
+package stomp
+
+import (
+	"encoding/json"
+	"os"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Action is the operation on a destination that the Authorizer permits or denies
+type Action string
+
+const (
+	ActionRead  Action = "read"  // SUBSCRIBE to the destination
+	ActionWrite Action = "write" // SEND to the destination
+)
+
+// Authorizer decides what the authenticated users may do. It is consulted for every SEND and SUBSCRIBE.
+type Authorizer interface {
+	// Authorize returns an error if the principal may not perform the action on the destination. The destination of
+	// a SUBSCRIBE may be a wildcard pattern.
+	Authorize(principal string, action Action, dest string) error
+}
+
+// FileAuthorizer authenticates the users with their bcrypt-hashed passwords and authorizes them by the destination
+// patterns they may read and write, as loaded from a JSON file of the form:
+//
+//	{
+//	  "users": [
+//	    {
+//	      "login": "admin",
+//	      "password": "$2a$10$...",
+//	      "read": ["/queue/>", "/topic/>"],
+//	      "write": ["/queue/orders.*"]
+//	    }
+//	  ]
+//	}
+//
+// The patterns use the same wildcards as the subscriptions.
+type FileAuthorizer struct {
+	users map[string]*fileUser
+}
+
+type fileUser struct {
+	Login    string   `json:"login"`
+	Password string   `json:"password"` // bcrypt hash
+	Read     []string `json:"read"`
+	Write    []string `json:"write"`
+}
+
+// NewFileAuthorizer loads the users and their permissions from the file at path
+func NewFileAuthorizer(path string) (*FileAuthorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errorMsg(errAuthorization, "Read failed: "+err.Error())
+	}
+	var file struct {
+		Users []*fileUser `json:"users"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, errorMsg(errAuthorization, "Invalid file "+path+": "+err.Error())
+	}
+
+	fa := &FileAuthorizer{users: map[string]*fileUser{}}
+	for _, u := range file.Users {
+		if u.Login == "" {
+			return nil, errorMsg(errAuthorization, "Missing login in "+path)
+		}
+		if _, err = bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, errorMsg(errAuthorization, "Invalid password hash for "+u.Login+": "+err.Error())
+		}
+		for _, pattern := range append(append([]string{}, u.Read...), u.Write...) {
+			if err = validateWildcardDest(pattern); err != nil {
+				return nil, err
+			}
+		}
+		fa.users[u.Login] = u
+	}
+	return fa, nil
+}
+
+// Login checks the passcode against the user's password hash, it is to be used as the LoginFunc
+func (fa *FileAuthorizer) Login(login, passcode string) error {
+	u, ok := fa.users[login]
+	if !ok {
+		return errorMsg(errAuthentication, "Unknown user: "+login)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(passcode)); err != nil {
+		return errorMsg(errAuthentication, "Wrong passcode for user: "+login)
+	}
+	return nil
+}
+
+// Authorize permits the action if any of the user's patterns for it covers the destination
+func (fa *FileAuthorizer) Authorize(principal string, action Action, dest string) error {
+	if u, ok := fa.users[principal]; ok {
+		patterns := u.Read
+		if action == ActionWrite {
+			patterns = u.Write
+		}
+		for _, pattern := range patterns {
+			if patternCovers(pattern, dest) {
+				return nil
+			}
+		}
+	}
+	return errorMsg(errAuthorization, "User '"+principal+"' may not "+string(action)+" "+dest)
+}
+
+// patternCovers tells if every destination matched by dest, itself possibly a wildcard pattern, is matched by the
+// pattern
+func patternCovers(pattern, dest string) bool {
+	p, d := splitDest(pattern), splitDest(dest)
+	for i, seg := range p {
+		switch seg {
+		case wildcardZeroOrMore:
+			return true
+		case wildcardOneOrMore:
+			return len(d) > i && d[i] != wildcardZeroOrMore
+		case wildcardSegment:
+			if i >= len(d) || d[i] == wildcardOneOrMore || d[i] == wildcardZeroOrMore {
+				return false
+			}
+		default:
+			if i >= len(d) || d[i] != seg {
+				return false
+			}
+		}
+	}
+	return len(p) == len(d)
+}
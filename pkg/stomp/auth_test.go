@@ -0,0 +1,211 @@
+package stomp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_patternCovers(t *testing.T) {
+	tests := []struct {
+		pattern, dest string
+		want          bool
+	}{
+		{"/queue/orders", "/queue/orders", true},
+		{"/queue/orders", "/queue/orders.new", false},
+		{"/queue/orders.*", "/queue/orders.new", true},
+		{"/queue/orders.*", "/queue/orders.*", true},
+		{"/queue/orders.*", "/queue/orders.>", false},
+		{"/queue/orders.>", "/queue/orders.new.eu", true},
+		{"/queue/orders.>", "/queue/orders.>", true},
+		{"/queue/orders.>", "/queue/orders.#", false},
+		{"/queue/orders.>", "/queue/orders", false},
+		{"/queue/#", "/queue/orders.#", true},
+		{"/queue/#", "/topic/orders", false},
+	}
+	for _, test := range tests {
+		if got := patternCovers(test.pattern, test.dest); got != test.want {
+			t.Errorf("patternCovers(%q, %q) = %v", test.pattern, test.dest, got)
+		}
+	}
+}
+
+func newTestAuthorizer(t *testing.T) *FileAuthorizer {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err = os.WriteFile(path, []byte(`{"users": [{
+		"login": "alice",
+		"password": "`+string(hash)+`",
+		"read": ["/topic/>"],
+		"write": ["/queue/orders.*"]
+	}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fa, err := NewFileAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fa
+}
+
+func TestFileAuthorizer(t *testing.T) {
+	fa := newTestAuthorizer(t)
+
+	if err := fa.Login("alice", "s3cret"); err != nil {
+		t.Error(err)
+	}
+	if err := fa.Login("alice", "wrong"); err == nil {
+		t.Error("expected error for the wrong passcode")
+	}
+	if err := fa.Login("bob", "s3cret"); err == nil {
+		t.Error("expected error for the unknown user")
+	}
+
+	if err := fa.Authorize("alice", ActionRead, "/topic/news.>"); err != nil {
+		t.Error(err)
+	}
+	if err := fa.Authorize("alice", ActionWrite, "/topic/news"); err == nil {
+		t.Error("expected error writing to the read-only destination")
+	}
+	if err := fa.Authorize("alice", ActionWrite, "/queue/orders.new"); err != nil {
+		t.Error(err)
+	}
+	if err := fa.Authorize("bob", ActionRead, "/topic/news"); err == nil {
+		t.Error("expected error for the unknown user")
+	}
+
+	// The file is validated on loading
+	path := filepath.Join(t.TempDir(), "bad.json")
+	for _, content := range []string{
+		`{"users": [{"login": "carol", "password": "plain"}]}`,
+		`{"users": [{"password": "` + fa.users["alice"].Password + `"}]}`,
+		`{"users": [{"login": "carol", "password": "` + fa.users["alice"].Password + `", "read": ["/queue/a.#.b"]}]}`,
+		`{"users": [`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFileAuthorizer(path); err == nil {
+			t.Error("expected error loading:", content)
+		}
+	}
+}
+
+func TestSessionAuthorization(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.Authorizer = newTestAuthorizer(t)
+	sess, _ := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+	sess.principal = "alice"
+
+	subscribe := func(dest string) error {
+		return sess.stateMachine(NewFrame(CmdSubscribe, map[Header]string{HdrKeyDestination: dest, HdrKeyID: dest}, nil))
+	}
+	send := func(dest string) error {
+		return sess.stateMachine(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, nil))
+	}
+
+	if err := subscribe("/topic/news"); err != nil {
+		t.Error(err)
+	}
+	if err := subscribe("/queue/orders.new"); err == nil {
+		t.Error("expected error subscribing to the unreadable destination")
+	}
+	if err := send("/queue/orders.new"); err != nil {
+		t.Error(err)
+	}
+	if err := send("/topic/news"); err == nil {
+		t.Error("expected error sending to the unwritable destination")
+	}
+}
+
+func TestAuthorizerRequiresAuthentication(t *testing.T) {
+	if _, err := StartBroker(&BrokerOpts{Port: "61612", Authorizer: newTestAuthorizer(t)}); err == nil {
+		t.Error("expected error for the Authorizer without authentication")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.Transport = TransportTCP
+	reg.opts.LoginFunc = func(login, passcode string) error {
+		t.Error("LoginFunc called along with the Authenticator")
+		return nil
+	}
+	infos := make(chan *ConnectInfo, 1)
+	reg.opts.Authenticator = func(info *ConnectInfo) (string, error) {
+		infos <- info
+		if info.Passcode != "s3cret" {
+			return "", errorMsg(errInvalidArg, "wrong passcode")
+		}
+		return "user:" + info.Login, nil
+	}
+	reg.opts.Authorizer = newTestAuthorizer(t)
+	started := make(chan *Session, 1)
+	reg.opts.OnSessionStart = func(sess *Session) { started <- sess }
+
+	connect := func(sess *Session, passcode string) error {
+		return sess.stateMachine(NewFrame(CmdConnect, map[Header]string{
+			HdrKeyAcceptVersion: supportedVersion,
+			HdrKeyHost:          "vhost",
+			HdrKeyLogin:         "alice",
+			HdrKeyPassCode:      passcode,
+			"client-id":         "c1",
+		}, nil))
+	}
+
+	sess, ch := newTestSession(t, reg)
+	if err := connect(sess, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	info := <-infos
+	if info.RemoteAddr == nil || info.VirtualHost != "vhost" || info.Transport != TransportTCP || info.TLS != nil ||
+		info.Login != "alice" || info.Headers["client-id"] != "c1" || info.PeerCertificate() != nil {
+		t.Errorf("ConnectInfo: %+v", info)
+	}
+	if sess.Principal() != "user:alice" {
+		t.Error("principal:", sess.Principal())
+	}
+	if s := <-started; s != sess || !strings.HasPrefix(s.ID(), "user:alice@") {
+		t.Error("session started:", s.ID())
+	}
+	if f := recvFrame(t, ch); f.getHeader(HdrKeySession) != sess.ID() {
+		t.Error("CONNECTED:", f)
+	}
+
+	// The session connects once, and keeps the key of its subscriptions
+	id := sess.ID()
+	if err := connect(sess, "s3cret"); err == nil {
+		t.Error("expected error for the second CONNECT")
+	}
+	if sess.ID() != id {
+		t.Error("session ID changed:", sess.ID())
+	}
+	if err := reg.addSubscription("/topic/news", "news", HdrValAckAuto, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.cleanupSubscriptions(sess.sessionID); err != nil {
+		t.Error(err)
+	}
+	if _, ok := reg.subsToDestMap[subsKey{sessionID: sess.sessionID, subsID: "news"}]; ok {
+		t.Error("subscription not cleaned up")
+	}
+
+	// The Authorizer knows the user by the principal
+	err := sess.stateMachine(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: "/queue/orders.new"}, nil))
+	if err == nil {
+		t.Error("expected error sending as the principal unknown to the Authorizer")
+	}
+
+	sess, _ = newTestSession(t, reg)
+	if err = connect(sess, "wrong"); err == nil {
+		t.Error("expected error for the wrong passcode")
+	}
+	<-infos
+}
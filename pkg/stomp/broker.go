@@ -1,16 +1,18 @@
 package stomp
 
 import (
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff"
-	"github.com/go-co-op/gocron"
+	set "github.com/deckarep/golang-set"
 	"github.com/google/uuid"
 )
 
@@ -18,66 +20,221 @@ import (
 type Session struct {
 	conn               net.Conn
 	sessionID          string
-	loginFunc          LoginFunc
+	reg                *registry
 	wgSessions         *sync.WaitGroup
 	hbSendIntervalMsec int
 	hbRecvIntervalMsec int
-	hbJob              *gocron.Job
+	hb                 *heartbeater
+	tlsState           *tls.ConnectionState // TLS state of the websocket connection, nil for the plain ones
+	reader             *readTracker         // Reads from conn, tracking the client's liveness
+	txIDs              set.Set              // Transactions begun by the session
+	principal          string               // User authenticated by the CONNECT
+	connected          bool                 // Set once the CONNECT is accepted
+	outbound           chan []byte          // Frames queued for the writer
+	done               chan struct{}        // Closed when the session ends, stops the writer
+	writerExited       chan struct{}        // Closed once the writer has flushed the outbound queue
+	doneOnce           sync.Once
+	closeOnce          sync.Once
 }
 
-// NewSession creates a new session object & maintains the session state internally
-func NewSession(conn net.Conn, loginFunc LoginFunc, wg *sync.WaitGroup,
-	heartbeatSendIntervalMsec, heartbeatReceiveIntervalMsec int,
-) *Session {
-	return &Session{
+// sessionFlushTimeout bounds the wait for the queued frames to be written when the session ends
+const sessionFlushTimeout = 5 * time.Second
+
+// newSession creates a new session object on the broker's registry & maintains the session state internally
+func newSession(conn net.Conn, reg *registry, wg *sync.WaitGroup) *Session {
+	sess := &Session{
 		conn:               conn,
-		loginFunc:          loginFunc,
+		reg:                reg,
 		sessionID:          uuid.NewString(),
 		wgSessions:         wg,
-		hbSendIntervalMsec: heartbeatSendIntervalMsec,
-		hbRecvIntervalMsec: heartbeatReceiveIntervalMsec,
+		hbSendIntervalMsec: reg.opts.HeartbeatSendIntervalMsec,
+		hbRecvIntervalMsec: reg.opts.HeartbeatReceiveIntervalMsec,
+		reader:             newReadTracker(conn),
+		hb:                 newHeartbeater(),
+		txIDs:              set.NewSet(),
+		outbound:           make(chan []byte, reg.opts.OutboundQueueSize),
+		done:               make(chan struct{}),
+		writerExited:       make(chan struct{}),
 	}
+	go sess.writer()
+	return sess
 }
 
 // LoginFunc represents the user-defined authentication function
 type LoginFunc func(login, passcode string) error
 
+// TLSLoginFunc represents the user-defined authentication function checking the client certificate as well. The
+// peerCert is the verified certificate the client presented over TLS, nil if the connection is not TLS or the client
+// did not present one.
+type TLSLoginFunc func(login, passcode string, peerCert *x509.Certificate) error
+
+// ConnectInfo describes the client connection and its CONNECT frame to the Authenticator
+type ConnectInfo struct {
+	RemoteAddr  net.Addr             // Address of the client
+	VirtualHost string               // The `host` header of the CONNECT
+	Transport   Transport            // Transport the client connected over
+	TLS         *tls.ConnectionState // TLS state of the connection, nil for the plain ones
+	Login       string               // The `login` header of the CONNECT
+	Passcode    string               // The `passcode` header of the CONNECT
+	Headers     map[Header]string    // All the headers of the CONNECT
+}
+
+// PeerCertificate returns the verified certificate the client presented over TLS, nil if there is none
+func (ci *ConnectInfo) PeerCertificate() *x509.Certificate {
+	if ci.TLS == nil || len(ci.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return ci.TLS.VerifiedChains[0][0]
+}
+
+// Authenticator represents the user-defined authentication function with access to the whole connection. It returns
+// the principal, the identity of the user that the session acts as from then on.
+type Authenticator func(info *ConnectInfo) (principal string, err error)
+
 // Start begins the STOMP session with the Client
 func (sess *Session) Start() {
 	defer sess.cleanup()
-	for raw := range frameScanner(sess.conn) {
+	for raw := range frameScanner(sess.reader) {
 		frame, err := NewFrameFromBytes(raw)
 		if err != nil {
-			_ = sess.sendError(err, fmt.Sprint("Frame serialization error:"+frame.String()))
+			_ = sess.sendError(err, nil, "Frame serialization error:\n"+string(raw))
 			return
 		}
 		if err = frame.Validate(ClientFrame); err != nil {
-			_ = sess.sendError(err, fmt.Sprint("Frame validation error:"+frame.String()))
+			_ = sess.sendError(err, frame, "Frame validation error:"+frame.String())
 			return
 		}
 
 		if err = sess.stateMachine(frame); err != nil {
 			log.Println(err)
+			_ = sess.sendError(err, frame, "Frame processing error:"+frame.String())
 			return
 		}
 	}
 }
 
 func (sess *Session) cleanup() {
-	_ = sess.conn.Close()
+	// Release the deliveries waiting for the room in the outbound queue first, they hold their subscriptions locked
+	sess.stop()
+	if err := sess.reg.cleanupSubscriptions(sess.sessionID); err != nil {
+		log.Println(err)
+	}
+	for _, txID := range sess.txIDs.ToSlice() {
+		_ = sess.reg.dropTx(sess.sessionID, txID.(string))
+	}
+	sess.reader.stop()
+	sess.hb.stop()
+	sess.close()
 	sess.wgSessions.Done()
-	if sess.hbJob != nil {
-		sched.RemoveByReference(sess.hbJob)
+}
+
+// stop ends the session: nothing more is queued, the frames already queued are written within the
+// sessionFlushTimeout
+func (sess *Session) stop() {
+	sess.doneOnce.Do(func() {
+		_ = sess.conn.SetWriteDeadline(time.Now().Add(sessionFlushTimeout))
+		close(sess.done)
+	})
+}
+
+// close stops the session and closes the connection once the queued frames are written
+func (sess *Session) close() {
+	sess.stop()
+	sess.closeOnce.Do(func() {
+		<-sess.writerExited
+		_ = sess.conn.Close()
+	})
+}
+
+// writer writes the frames from the outbound queue to the connection, so that a slow client holds up nobody but
+// itself. It flushes the queue once the session is done.
+func (sess *Session) writer() {
+	defer close(sess.writerExited)
+	for {
+		select {
+		case data := <-sess.outbound:
+			if err := sess.write(data); err != nil {
+				_ = sess.conn.Close()
+				return
+			}
+		case <-sess.done:
+			for {
+				select {
+				case data := <-sess.outbound:
+					if err := sess.write(data); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes the serialized frame or heartbeat to the connection, retrying on error
+func (sess *Session) write(data []byte) error {
+	writeIt := func() error {
+		if _, err := sess.conn.Write(data); err != nil {
+			log.Println(err)
+			return err
+		}
+		sess.hb.wrote()
+		return nil
+	}
+
+	// Retry writing on error
+	b := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 3)
+	return backoff.Retry(writeIt, b)
+}
+
+// enqueue queues the data for the writer. The frames to the session itself wait for the room in the queue, the
+// messages from the other sessions are subject to the SlowConsumerPolicy once the queue is full. Nothing waits once
+// the session is stopped or its writer has failed.
+func (sess *Session) enqueue(data []byte, policy SlowConsumerPolicy) {
+	select {
+	case sess.outbound <- data:
+		return
+	case <-sess.done:
+		return
+	case <-sess.writerExited:
+		return
+	default:
+	}
+
+	switch policy {
+	case SlowConsumerDrop:
+		log.Println("Outbound queue full, dropping the message for the session:", sess.sessionID)
+	case SlowConsumerDisconnect:
+		log.Println("Outbound queue full, disconnecting the slow session:", sess.sessionID)
+		_ = sess.conn.Close()
+	default:
+		select {
+		case sess.outbound <- data:
+		case <-sess.done:
+		case <-sess.writerExited:
+		}
 	}
 }
 
-// sendError is the helper function to send the ERROR frames
-func (sess *Session) sendError(err error, payload string) error {
-	return sess.send(CmdError, map[Header]string{
+// sendError is the helper function to send the ERROR frames. The offending frame, if known, is correlated by the
+// `receipt-id` when it asked for a receipt. A failed CONNECT also gets the supported protocol versions. The connection
+// is to be closed after sending the ERROR.
+func (sess *Session) sendError(err error, frame *Frame, payload string) error {
+	h := map[Header]string{
 		HdrKeyContentType:   "text/plain",
 		HdrKeyContentLength: strconv.Itoa(len(payload)),
 		HdrKeyMessage:       err.Error(),
-	}, []byte(payload))
+	}
+	if frame != nil {
+		if receipt := frame.getHeader(HdrKeyReceipt); receipt != "" {
+			h[HdrKeyReceiptID] = receipt
+		}
+		if frame.command == CmdConnect || frame.command == CmdStomp {
+			h[HdrKeyVersion] = supportedVersion
+		}
+	}
+	return sess.send(CmdError, h, []byte(payload))
 }
 
 // stateMachine is the brain of the protocol
@@ -89,77 +246,109 @@ func (sess *Session) stateMachine(frame *Frame) error {
 		}
 
 	case CmdSend:
+		if err := sess.authorize(ActionWrite, frame.getHeader(HdrKeyDestination)); err != nil {
+			return err
+		}
 		// If the message is part of an ongoing transaction
 		if txID := frame.getHeader(HdrKeyTransaction); txID != "" {
-			if err := bufferTxMessage(txID, frame); err != nil {
+			if err := sess.reg.bufferTxFrame(sess.sessionID, txID, frame); err != nil {
 				return err
 			}
-			return nil
+			break
 		}
 		// Not part of transaction
-		if err := publish(frame, ""); err != nil {
+		if err := sess.reg.publish(frame, ""); err != nil {
 			return err
 		}
 
 	case CmdSubscribe:
+		if err := sess.authorize(ActionRead, frame.getHeader(HdrKeyDestination)); err != nil {
+			return err
+		}
 		ack := HdrValAckAuto
-		if ackStr := frame.getHeader(HdrKeyAck); ackStr == "" {
+		if ackStr := frame.getHeader(HdrKeyAck); ackStr != "" {
 			ack = AckMode(ackStr)
 		}
-		if err := addSubscription(frame.getHeader(HdrKeyDestination), frame.getHeader(HdrKeyID), ack, sess); err != nil {
+		prefetch := sess.reg.opts.PrefetchSize
+		if prefetchStr := frame.getHeader(HdrKeyPrefetchSize); prefetchStr != "" {
+			n, err := strconv.Atoi(prefetchStr)
+			if err != nil || n < 0 {
+				return errorMsg(errBrokerStateMachine, "Invalid prefetch size: "+prefetchStr)
+			}
+			prefetch = n
+		}
+		if err := sess.reg.addSubscription(frame.getHeader(HdrKeyDestination), frame.getHeader(HdrKeyID), ack,
+			frame.getHeader(HdrKeySelector), prefetch, sess); err != nil {
 			return err
 		}
 
 	case CmdUnsubscribe:
-		if err := removeSubscription(frame.getHeader(HdrKeyID)); err != nil {
+		if err := sess.reg.removeSubscription(sess.sessionID, frame.getHeader(HdrKeyID)); err != nil {
 			return err
 		}
 
-	case CmdAck:
-		if err := processAck(frame.headers[HdrKeyID]); err != nil {
+	case CmdAck, CmdNack:
+		// If the acknowledgement is part of an ongoing transaction
+		if txID := frame.getHeader(HdrKeyTransaction); txID != "" {
+			if err := sess.reg.bufferTxFrame(sess.sessionID, txID, frame); err != nil {
+				return err
+			}
+			break
+		}
+		if err := sess.reg.acknowledge(sess.sessionID, frame); err != nil {
 			return err
 		}
 
-	case CmdNack:
-		// if err := processNack(frame.headers[HdrKeyID]); err != nil {
-		// 	return err
-		// }
-
 	case CmdBegin:
-		if err := startTx(frame.getHeader(HdrKeyTransaction)); err != nil {
+		if err := sess.reg.startTx(sess.sessionID, frame.getHeader(HdrKeyTransaction)); err != nil {
 			return err
 		}
+		sess.txIDs.Add(frame.getHeader(HdrKeyTransaction))
 
 	case CmdCommit:
 		txID := frame.getHeader(HdrKeyTransaction)
-		// Pick each message from TX buffer
-		if err := foreachTx(txID, func(frameTx *Frame) error {
-			// Send the message to each subscriber
-			if err := publish(frameTx, txID); err != nil {
-				return err
-			}
-			return nil
-		}); err != nil {
+		if err := sess.reg.commitTx(sess.sessionID, txID); err != nil {
 			return err
 		}
+		sess.txIDs.Remove(txID)
 
 	case CmdAbort:
 		txID := frame.getHeader(HdrKeyTransaction)
-		if err := dropTx(txID); err != nil {
+		if err := sess.reg.dropTx(sess.sessionID, txID); err != nil {
 			return err
 		}
+		sess.txIDs.Remove(txID)
 
 	case CmdDisconnect:
-		_ = cleanupSubscriptions(sess.sessionID)
-		_ = sess.send(CmdReceipt, map[Header]string{HdrKeyReceiptID: frame.getHeader(HdrKeyReceipt)}, nil)
-		_ = sess.conn.Close()
+		_ = sess.reg.cleanupSubscriptions(sess.sessionID)
+		_ = sess.sendReceipt(frame)
+		sess.close()
+		return nil
 	}
-	return nil
+	return sess.sendReceipt(frame)
+}
+
+// authorize checks with the Authorizer, if any, that the session's principal may perform the action on dest
+func (sess *Session) authorize(action Action, dest string) error {
+	if sess.reg.opts.Authorizer == nil {
+		return nil
+	}
+	return sess.reg.opts.Authorizer.Authorize(sess.principal, action, dest)
 }
 
-func (sess *Session) sendMessage(dest, subsID string, ackNum uint32, txID string, headers map[Header]string,
+// sendReceipt confirms the processing of the client frame if it asked for a receipt
+func (sess *Session) sendReceipt(frame *Frame) error {
+	receipt := frame.getHeader(HdrKeyReceipt)
+	if receipt == "" {
+		return nil
+	}
+	return sess.send(CmdReceipt, map[Header]string{HdrKeyReceiptID: receipt}, nil)
+}
+
+// messageFrame returns the serialized MESSAGE frame of the subscription, for the outbound queue
+func (sess *Session) messageFrame(dest, subsID string, ackNum uint32, txID string, headers map[Header]string,
 	body []byte,
-) error {
+) ([]byte, error) {
 	h := map[Header]string{
 		HdrKeyDestination:  dest,
 		HdrKeyMessageID:    uuid.NewString(),
@@ -170,25 +359,22 @@ func (sess *Session) sendMessage(dest, subsID string, ackNum uint32, txID string
 		h[HdrKeyTransaction] = txID
 	}
 	for k, v := range headers {
+		// The receipt was meant for the sender only
+		if k == HdrKeyReceipt {
+			continue
+		}
 		h[Header(strings.ToLower(string(k)))] = v
 	}
-	return sess.send(CmdMessage, h, body)
+	f := NewFrame(CmdMessage, h, body)
+	if err := f.Validate(ServerFrame); err != nil {
+		return nil, err
+	}
+	return f.Serialize(), nil
 }
 
+// sendRaw queues the heartbeat, unless the queue is full: the pending frames will tell the client the broker is alive
 func (sess *Session) sendRaw(body []byte) error {
-	sendIt := func() error {
-		if _, err := sess.conn.Write(body); err != nil {
-			log.Println(err)
-			return err
-		}
-		return nil
-	}
-
-	b := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 3)
-	if err := backoff.Retry(sendIt, b); err != nil {
-		return err
-	}
-
+	sess.enqueue(body, SlowConsumerDrop)
 	return nil
 }
 
@@ -199,46 +385,85 @@ func (sess *Session) send(cmd Command, headers map[Header]string, body []byte) e
 	if err := f.Validate(ServerFrame); err != nil {
 		return err
 	}
+	sess.enqueue(f.Serialize(), SlowConsumerBlock)
+	return nil
+}
 
-	sendIt := func() error {
-		if _, err := sess.conn.Write(f.Serialize()); err != nil {
-			log.Println(err)
-			return err
-		}
-		return nil
+// connectInfo gathers the details of the connection and its CONNECT frame
+func (sess *Session) connectInfo(f *Frame) *ConnectInfo {
+	state := sess.tlsState
+	if tlsConn, ok := sess.conn.(*tls.Conn); ok {
+		s := tlsConn.ConnectionState()
+		state = &s
 	}
+	return &ConnectInfo{
+		RemoteAddr:  sess.conn.RemoteAddr(),
+		VirtualHost: f.getHeader(HdrKeyHost),
+		Transport:   sess.reg.opts.Transport,
+		TLS:         state,
+		Login:       f.getHeader(HdrKeyLogin),
+		Passcode:    f.getHeader(HdrKeyPassCode),
+		Headers:     f.clone().headers,
+	}
+}
 
-	// Retry sending on error
-	b := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 3)
-	if err := backoff.Retry(sendIt, b); err != nil {
-		return err
+// ID returns the session identifier, as sent to the client in the `session` header of CONNECTED. Once authenticated,
+// the identifier is prefixed by the principal as `<principal>@`.
+func (sess *Session) ID() string {
+	if sess.principal != "" {
+		return sess.principal + "@" + sess.sessionID
 	}
+	return sess.sessionID
+}
 
-	return nil
+// Principal returns the user the session is authenticated as, empty before the CONNECT or for the anonymous users
+func (sess *Session) Principal() string {
+	return sess.principal
 }
 
 // handleConnect responds to the CONNECT message from client
 func (sess *Session) handleConnect(f *Frame) error {
+	if sess.connected {
+		return errorMsg(errBrokerStateMachine, "Session already connected: "+sess.ID())
+	}
+
 	// Authentication
-	if sess.loginFunc != nil {
-		login, passcode := f.getHeader(HdrKeyLogin), f.getHeader(HdrKeyPassCode)
-		if err := sess.loginFunc(login, passcode); err != nil {
-			_ = sess.sendError(errors.New("login failed"), "Authentication failed:\n"+err.Error())
-			return errorMsg(errBrokerStateMachine, "Login error: "+err.Error())
+	info := sess.connectInfo(f)
+	switch {
+	case sess.reg.opts.Authenticator != nil:
+		principal, err := sess.reg.opts.Authenticator(info)
+		if err != nil {
+			return errorMsg(errAuthentication, "Login error: "+err.Error())
+		}
+		sess.principal = principal
+	case sess.reg.opts.TLSLoginFunc != nil:
+		if err := sess.reg.opts.TLSLoginFunc(info.Login, info.Passcode, info.PeerCertificate()); err != nil {
+			return errorMsg(errAuthentication, "Login error: "+err.Error())
+		}
+		sess.principal = info.Login
+	case sess.reg.opts.LoginFunc != nil:
+		if err := sess.reg.opts.LoginFunc(info.Login, info.Passcode); err != nil {
+			return errorMsg(errAuthentication, "Login error: "+err.Error())
 		}
+		sess.principal = info.Login
+	default:
+		sess.principal = info.Login
+	}
+	if sess.reg.opts.OnSessionStart != nil {
+		sess.reg.opts.OnSessionStart(sess)
 	}
 
 	// Version negotiation
 	ver := ""
 	for _, v := range strings.Split(f.getHeader(HdrKeyAcceptVersion), ",") {
-		if v == "1.2" {
-			ver = "1.2"
+		if v == supportedVersion {
+			ver = supportedVersion
 			break
 		}
 	}
 	if ver == "" {
-		// Send version ERROR
-		return errorMsg(errBrokerStateMachine, "Invalid client version received: "+f.getHeader(HdrKeyVersion))
+		return errorMsg(errBrokerStateMachine,
+			"Invalid client version received: "+f.getHeader(HdrKeyAcceptVersion))
 	}
 
 	// Heartbeat negotiation
@@ -246,17 +471,30 @@ func (sess *Session) handleConnect(f *Frame) error {
 		if err := sess.negotiateHeartbeats(hbVal); err != nil {
 			return errorMsg(errBrokerStateMachine, "Heartbeat negotiation: "+err.Error())
 		}
+	} else {
+		// No heartbeats without the client agreeing on them
+		sess.hbSendIntervalMsec, sess.hbRecvIntervalMsec = 0, 0
+	}
+
+	// Liveness of the client, it is dead if not even a heartbeat arrives within the interval and the grace
+	if sess.hbRecvIntervalMsec > 0 {
+		timeout := time.Duration(sess.hbRecvIntervalMsec+sess.reg.opts.HeartbeatGraceMsec) * time.Millisecond
+		sess.reader.watch(timeout, func() {
+			log.Println("No heartbeat from the client, closing the session:", sess.sessionID)
+			_ = sess.conn.Close()
+		})
 	}
 
 	// Respond with CONNECTED
 	if err := sess.send(CmdConnected, map[Header]string{
 		HdrKeyVersion:   ver,
-		HdrKeySession:   sess.sessionID,
+		HdrKeySession:   sess.ID(),
 		HdrKeyServer:    "go-proto-stomp/" + releaseVersion,
 		HdrKeyHeartBeat: fmt.Sprintf("%d,%d", sess.hbSendIntervalMsec, sess.hbRecvIntervalMsec),
 	}, nil); err != nil {
 		return err
 	}
+	sess.connected = true
 
 	return nil
 }
@@ -282,19 +520,22 @@ func (sess *Session) negotiateHeartbeats(hbVal string) error {
 		sess.hbSendIntervalMsec = clientRecvInterval
 	}
 
-	// Schedule sending heartbeats by hbSendIntervalMsec
-	sess.hbJob, err = sched.Every(sess.hbSendIntervalMsec).Milliseconds().Tag(sess.sessionID).Do(
-		func() {
-			_ = sess.sendRaw([]byte("\n"))
-		})
-	if err != nil {
-		return errorMsg(errBrokerStateMachine, "Heartbeat setup error: "+err.Error())
-	}
-	sched.StartAsync()
-
+	// Send heartbeats by hbSendIntervalMsec
+	sess.hb.start(time.Duration(sess.hbSendIntervalMsec)*time.Millisecond, func() error {
+		return sess.sendRaw([]byte("\n"))
+	})
 	return nil
 }
 
+// SlowConsumerPolicy decides what happens to a message for a session whose outbound queue is full
+type SlowConsumerPolicy string
+
+const (
+	SlowConsumerBlock      SlowConsumerPolicy = "block"      // Wait for the room in the queue, holding up the sender
+	SlowConsumerDrop       SlowConsumerPolicy = "drop"       // Discard the message for the session
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect" // Close the session, its unacknowledged messages requeued
+)
+
 // Broker lists the methods supported by the STOMP brokers
 type Broker interface {
 	// ListenAndServe is a blocking method that keeps accepting the client connections and handles the STOMP messages.
@@ -304,6 +545,24 @@ type Broker interface {
 	Shutdown()
 }
 
+// DispatchPolicy decides which subscriber of a queue destination receives the message
+type DispatchPolicy string
+
+const (
+	DispatchRoundRobin  DispatchPolicy = "round-robin"  // Subscribers take turns
+	DispatchLeastLoaded DispatchPolicy = "least-loaded" // Subscriber with the fewest unacknowledged messages
+)
+
+// OverflowPolicy decides what happens to a message sent to a queue destination without subscribers, when the
+// destination already holds as many messages as allowed
+type OverflowPolicy string
+
+const (
+	OverflowDropOldest OverflowPolicy = "drop-oldest" // Discard the oldest held message to make room
+	OverflowDropNewest OverflowPolicy = "drop-newest" // Discard the message being sent
+	OverflowReject     OverflowPolicy = "reject"      // Reply to the sender with ERROR
+)
+
 // BrokerOpts is passed as an argument to StartBroker
 type BrokerOpts struct {
 	// Transport refers to the underlying protocol for STOMP.
@@ -320,6 +579,30 @@ type BrokerOpts struct {
 	// It is of the form `func(login, passcode string) error`
 	LoginFunc LoginFunc
 
+	// TLSLoginFunc is a user defined function for authenticating the user along with the client certificate of the
+	// TLS connection. It takes precedence over the LoginFunc. Default: nil
+	// It is of the form `func(login, passcode string, peerCert *x509.Certificate) error`
+	TLSLoginFunc TLSLoginFunc
+
+	// Authenticator is a user defined function for authenticating the user, given the details of the connection and
+	// its CONNECT. The principal it returns is attached to the session. It takes precedence over the login functions.
+	// Default: nil
+	Authenticator Authenticator
+
+	// OnSessionStart is a user defined function called once the session is authenticated, before the CONNECTED is
+	// sent. The ID and the Principal of the session are set by then. Default: nil
+	OnSessionStart func(sess *Session)
+
+	// Authorizer decides which destinations the users may SEND to and SUBSCRIBE to. The user is the principal
+	// returned by the Authenticator, or else the `login` of the CONNECT checked by the TLSLoginFunc or the LoginFunc.
+	// One of them is required along with the Authorizer. Default: nil (everything allowed)
+	Authorizer Authorizer
+
+	// TLSConfig enables TLS for the transport: `stomp+ssl` over TCP or `wss://` for Websocket. It must carry the
+	// server certificate. Set its ClientAuth (e.g. tls.RequireAndVerifyClientCert) and ClientCAs for mutual TLS.
+	// Default: nil (no TLS)
+	TLSConfig *tls.Config
+
 	// HeartbeatSendIntervalMsec is the interval in milliseconds by which the broker can send heartbeats.
 	// The broker will negotiate using this value with the client. Default: 0 (no heartbeats)
 	// It will not send the heartbeats by an interval any smaller than this value.
@@ -329,6 +612,68 @@ type BrokerOpts struct {
 	// The broker will negotiate using this value with the client. Default: 0 (no heartbeats)
 	// This is to tell the client that the broker cannot receive heartbeats by any shorter interval than this value.
 	HeartbeatReceiveIntervalMsec int
+
+	// HeartbeatGraceMsec is the margin in milliseconds allowed to the client beyond the negotiated heartbeat interval.
+	// The session of a client from which nothing arrives within the interval and the margin is closed.
+	// Default: 1000 (DefaultHeartbeatGraceMsec)
+	HeartbeatGraceMsec int
+
+	// MaxRedeliveries is the number of times a NACKed message is redelivered before it is moved to the dead-letter
+	// destination. Default: 5 (DefaultMaxRedeliveries)
+	MaxRedeliveries int
+
+	// DeadLetterPrefix is prepended to the destination of a message that exceeded MaxRedeliveries, e.g. a message
+	// for `/queue/foo` ends up in `/dlq/queue/foo`. Default: "/dlq" (DefaultDeadLetterPrefix)
+	DeadLetterPrefix string
+
+	// QueuePrefix marks the destinations with point-to-point semantics: each message is delivered to exactly one of
+	// the subscribers. Messages to all the other destinations (e.g. `/topic/...`) are delivered to every subscriber.
+	// The dead-letter destinations are always queues. Default: "/queue/" (DefaultQueuePrefix)
+	QueuePrefix string
+
+	// QueueDispatch is the policy for choosing the subscriber of a queue destination.
+	// Choices: DispatchRoundRobin, DispatchLeastLoaded. Default: DispatchRoundRobin
+	QueueDispatch DispatchPolicy
+
+	// PrefetchSize caps the messages delivered to a subscription in the `client` or `client-individual` mode and not
+	// yet acknowledged. Further messages wait for the ACK/NACK to make room, held by their queue destination or, for
+	// the topics, in the backlog of the subscription. A subscription may set its own limit
+	// with the `activemq.prefetchSize` header, 0 lifting it. Default: 0 (no limit)
+	PrefetchSize int
+
+	// OutboundQueueSize is the number of frames queued for writing to a session. A slow client only holds up its own
+	// queue, until it fills up. Default: 1000 (DefaultOutboundQueueSize)
+	OutboundQueueSize int
+
+	// SlowConsumerPolicy applies to the messages for a session whose outbound queue is full.
+	// Choices: SlowConsumerBlock, SlowConsumerDrop, SlowConsumerDisconnect. Default: SlowConsumerBlock
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// MaxTxLifetime is the time a transaction may stay open. Once it is over the transaction is rolled back, and
+	// the client gets ERROR on its COMMIT. Default: 0 (no limit)
+	MaxTxLifetime time.Duration
+
+	// MaxTxFrames is the number of SEND, ACK and NACK frames a transaction may buffer. The client exceeding it gets
+	// ERROR, which ends the session and rolls back its transactions. Default: 1000 (DefaultMaxTxFrames)
+	MaxTxFrames int
+
+	// MessageStore persists the messages sent to the queue destinations until they are acknowledged. The stored
+	// messages are replayed by StartBroker and delivered once the subscribers arrive. Default: nil (no persistence)
+	MessageStore MessageStore
+
+	// MaxHeldMessages is the number of messages a queue destination without subscribers, or with all of them at their
+	// prefetch limit, holds for the first subscriber to have room. It also caps the topic messages waiting for a
+	// subscriber at its prefetch limit, beyond which the SlowConsumerPolicy applies. Default: 1000
+	// (DefaultMaxHeldMessages)
+	MaxHeldMessages int
+
+	// MaxHeldBytes limits the total size of the message bodies held by a queue destination without subscribers.
+	// A single message larger than the limit is always rejected. Default: 0 (no limit)
+	MaxHeldBytes int
+
+	// OverflowPolicy applies when a message sent to a queue destination without subscribers exceeds MaxHeldMessages
+	// or MaxHeldBytes. Choices: OverflowDropOldest, OverflowDropNewest, OverflowReject. Default: OverflowDropOldest
+	OverflowPolicy OverflowPolicy
 }
 
 // StartBroker is the entry point for the STOMP broker.
@@ -336,6 +681,11 @@ func StartBroker(opts *BrokerOpts) (Broker, error) {
 	var broker Broker
 	var err error
 
+	// The principals checked by the Authorizer must be authenticated, not just claimed by the clients
+	if opts.Authorizer != nil && opts.LoginFunc == nil && opts.TLSLoginFunc == nil && opts.Authenticator == nil {
+		return nil, errorMsg(errInvalidArg, "Authorizer set without a LoginFunc, a TLSLoginFunc or an Authenticator")
+	}
+
 	// Set default values
 	if opts.Host == "" {
 		opts.Host = "localhost"
@@ -352,17 +702,68 @@ func StartBroker(opts *BrokerOpts) (Broker, error) {
 	if opts.HeartbeatReceiveIntervalMsec < 0 {
 		opts.HeartbeatReceiveIntervalMsec = 0
 	}
+	if opts.HeartbeatGraceMsec <= 0 {
+		opts.HeartbeatGraceMsec = DefaultHeartbeatGraceMsec
+	}
+	if opts.MaxRedeliveries <= 0 {
+		opts.MaxRedeliveries = DefaultMaxRedeliveries
+	}
+	if opts.DeadLetterPrefix == "" {
+		opts.DeadLetterPrefix = DefaultDeadLetterPrefix
+	}
+	if opts.QueuePrefix == "" {
+		opts.QueuePrefix = DefaultQueuePrefix
+	}
+	if opts.QueueDispatch == "" {
+		opts.QueueDispatch = DispatchRoundRobin
+	}
+	if opts.PrefetchSize < 0 {
+		opts.PrefetchSize = 0
+	}
+	if opts.OutboundQueueSize <= 0 {
+		opts.OutboundQueueSize = DefaultOutboundQueueSize
+	}
+	if opts.SlowConsumerPolicy == "" {
+		opts.SlowConsumerPolicy = SlowConsumerBlock
+	}
+	if opts.MaxTxLifetime < 0 {
+		opts.MaxTxLifetime = 0
+	}
+	if opts.MaxTxFrames <= 0 {
+		opts.MaxTxFrames = DefaultMaxTxFrames
+	}
+	if opts.MaxHeldMessages <= 0 {
+		opts.MaxHeldMessages = DefaultMaxHeldMessages
+	}
+	if opts.MaxHeldBytes < 0 {
+		opts.MaxHeldBytes = 0
+	}
+	if opts.OverflowPolicy == "" {
+		opts.OverflowPolicy = OverflowDropOldest
+	}
+
+	reg := newRegistry(opts)
+
+	// Recover the messages persisted before the restart
+	if opts.MessageStore != nil {
+		if err = opts.MessageStore.Replay(func(frame *Frame) error {
+			reg.holdFrame(frame.getHeader(HdrKeyDestination), frame)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
 
 	switch opts.Transport {
 	case TransportTCP:
 		var tcp *tcpBroker
-		if tcp, err = startTcpBroker(opts); err != nil {
+		if tcp, err = startTcpBroker(reg); err != nil {
 			return nil, err
 		}
 		broker = tcp
 	case TransportWebsocket:
 		var wss *wssBroker
-		if wss, err = startWebsocketBroker(opts); err != nil {
+		if wss, err = startWebsocketBroker(reg); err != nil {
 			return nil, err
 		}
 		broker = wss
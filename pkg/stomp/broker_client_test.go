@@ -1,14 +1,18 @@
 package stomp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -84,8 +88,13 @@ func TestStartBroker(t *testing.T) {
 				}
 			})
 
-			if err = c.Connect(false); err != nil {
-				t.Error(err)
+			var info *SessionInfo
+			if info, err = c.Connect(false); err != nil {
+				t.Fatal(err)
+			}
+			if info.Version != supportedVersion || info.SessionID != c.SessionID ||
+				!strings.HasPrefix(info.Server, "go-proto-stomp/") {
+				t.Error(info)
 			}
 
 			var subs *Subscription
@@ -99,6 +108,22 @@ func TestStartBroker(t *testing.T) {
 			}
 			testValidateID++
 
+			// Receipts
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var subsReceipt *Subscription
+			if subsReceipt, err = c.Subscribe(dest, HdrValAckAuto, WithReceipt(ctx)); err != nil {
+				t.Error(err)
+			}
+			if err = c.SendWithReceipt(ctx, dest, []byte(strconv.Itoa(testValidateID)), "plain/text",
+				customTestHeader(testValidateID)); err != nil {
+				t.Error(err)
+			}
+			testValidateID++
+			if err = subsReceipt.Unsubscribe(); err != nil {
+				t.Error(err)
+			}
+
 			beginCommitTx(t, c, dest, testValidateID)
 			testValidateID++
 
@@ -118,7 +143,7 @@ func TestStartBroker(t *testing.T) {
 			}
 
 			// Wrong login
-			if err = failedLogin(test.transport, test.port); err != nil {
+			if err = failedLogin(test.transport, test.port); !errors.Is(err, ErrAuthentication) {
 				t.Error(err)
 			}
 
@@ -126,14 +151,11 @@ func TestStartBroker(t *testing.T) {
 			sendWrongHeartbeat(t, test.transport, test.port)
 		})
 	}
-
-	tcp.Shutdown()
-	wss.Shutdown()
 }
 
 func failedLogin(transport Transport, port string) error {
 	cx := NewClientHandler(transport, "localhost", port, nil)
-	if err := cx.Connect(true); err != nil {
+	if _, err := cx.Connect(true); err != nil {
 		return err
 	}
 	if err := cx.Disconnect(); err != nil {
@@ -185,8 +207,8 @@ func sendWrongHeartbeat(t *testing.T, transport Transport, port string) {
 }
 
 func sendErrorFrame(transport Transport, port string) error {
-	c := NewClientHandler(transport, "localhost", port, nil)
-	if err := c.Connect(true); err != nil {
+	c := NewClientHandler(transport, "localhost", port, &ClientOpts{Login: "admin", Passcode: "9a$$w0rd"})
+	if _, err := c.Connect(true); err != nil {
 		return err
 	}
 	f := NewFrame("WRONG_HEADER", nil, nil)
@@ -196,6 +218,631 @@ func sendErrorFrame(transport Transport, port string) error {
 	return nil
 }
 
+func readTestFrame(t *testing.T, frames <-chan []byte) *Frame {
+	select {
+	case raw, ok := <-frames:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		f, err := NewFrameFromBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for frame")
+	}
+	return nil
+}
+
+func TestSessionErrorFrame(t *testing.T) {
+	connect := NewFrame(CmdConnect, map[Header]string{
+		HdrKeyHost:          "localhost",
+		HdrKeyAcceptVersion: supportedVersion,
+		HdrKeyLogin:         "admin",
+		HdrKeyPassCode:      "9a$$w0rd",
+	}, nil)
+
+	tests := []struct {
+		name    string
+		frames  []*Frame
+		headers map[Header]string
+	}{
+		{
+			name: "unknown subscription",
+			frames: []*Frame{connect, NewFrame(CmdUnsubscribe, map[Header]string{
+				HdrKeyID:      "missing",
+				HdrKeyReceipt: "unsubscribe-1",
+			}, nil)},
+			headers: map[Header]string{HdrKeyReceiptID: "unsubscribe-1"},
+		},
+		{
+			name: "unknown transaction",
+			frames: []*Frame{connect, NewFrame(CmdCommit, map[Header]string{
+				HdrKeyTransaction: "missing",
+				HdrKeyReceipt:     "commit-1",
+			}, nil)},
+			headers: map[Header]string{HdrKeyReceiptID: "commit-1"},
+		},
+		{
+			name: "bad version",
+			frames: []*Frame{NewFrame(CmdConnect, map[Header]string{
+				HdrKeyHost:          "localhost",
+				HdrKeyAcceptVersion: "1.0,1.1",
+			}, nil)},
+			headers: map[Header]string{HdrKeyVersion: supportedVersion},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := startTcpClient(context.Background(), "localhost", DefaultPort, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+			frames := frameScanner(conn)
+
+			for _, f := range test.frames {
+				if _, err = conn.Write(f.Serialize()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(test.frames) > 1 {
+				if f := readTestFrame(t, frames); f.command != CmdConnected {
+					t.Fatal(f)
+				}
+			}
+
+			f := readTestFrame(t, frames)
+			if f.command != CmdError || f.getHeader(HdrKeyMessage) == "" ||
+				!strings.Contains(string(f.body), string(test.frames[len(test.frames)-1].command)) {
+				t.Error(f)
+			}
+			for h, v := range test.headers {
+				if f.getHeader(h) != v {
+					t.Error(h, f)
+				}
+			}
+
+			// Connection is closed after the ERROR
+			select {
+			case _, ok := <-frames:
+				if ok {
+					t.Error("expected the connection to be closed")
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("timed out waiting for the connection to close")
+			}
+		})
+	}
+}
+
+func TestDial(t *testing.T) {
+	for _, test := range []struct {
+		transport Transport
+		addr      string
+	}{
+		{TransportTCP, "localhost:" + DefaultPort},
+		{TransportWebsocket, "localhost:9991"},
+	} {
+		t.Run(string(test.transport), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c, err := Dial(ctx, test.transport, test.addr, &ClientOpts{Login: "admin", Passcode: "9a$$w0rd"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.SessionID == "" {
+				t.Error("missing session ID")
+			}
+			if err = c.Disconnect(); err != nil {
+				t.Error(err)
+			}
+
+			if _, err = Dial(ctx, test.transport, test.addr, &ClientOpts{Login: "admin"}); !errors.Is(err,
+				ErrAuthentication) {
+				t.Error(err)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := Dial(ctx, "UDP", "localhost:"+DefaultPort, nil); !errors.Is(err, ErrInvalidTransport) {
+		t.Error(err)
+	}
+	if _, err := Dial(ctx, TransportTCP, "localhost:1", nil); !errors.Is(err, ErrDialFailed) {
+		t.Error(err)
+	}
+
+	// The listener accepts but never responds to CONNECT
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = Dial(ctx, TransportTCP, l.Addr().String(), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(err)
+	}
+}
+
+func Test_notifyReceipt(t *testing.T) {
+	c := &ClientHandler{receipts: map[string]chan error{"receipt": make(chan error, 1)}}
+
+	// The receipt failed by the lost connection arrives after all
+	done := make(chan struct{})
+	go func() {
+		c.failReceipts(ErrConnectionLost)
+		c.notifyReceipt("receipt", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notifyReceipt blocked on the receipt notified already")
+	}
+	if err := <-c.receipts["receipt"]; !errors.Is(err, ErrConnectionLost) {
+		t.Error(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	states := make(chan ConnectionState, 10)
+	messages := make(chan string, 10)
+	expectState := func(want ConnectionState) {
+		select {
+		case state := <-states:
+			if state != want {
+				t.Fatal("state:", state, "expected:", want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for state:", want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, TransportTCP, "localhost:"+DefaultPort, &ClientOpts{
+		Login:          "admin",
+		Passcode:       "9a$$w0rd",
+		MessageHandler: func(message *UserMessage) { messages <- string(message.Body) },
+		Reconnect:      &ReconnectPolicy{InitialInterval: 10 * time.Millisecond},
+		OnStateChange:  func(state ConnectionState, err error) { states <- state },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := "/topic/reconnect"
+	if _, err = c.Subscribe(dest, HdrValAckAuto, WithReceipt(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := c.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Send(dest, []byte("in-tx"), "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction acknowledging a message is not recovered
+	queued, err := c.Subscribe("/queue/reconnect", HdrValAckClientIndividual, WithReceipt(ctx), WithMessages(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Send("/queue/reconnect", []byte("acked"), "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	ackTx, err := c.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-queued.Messages():
+		if err = ackTx.Ack(m); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	sessionID := c.SessionID
+
+	// Drop the connection
+	_ = c.getConn().Close()
+	expectState(StateReconnecting)
+	expectState(StateConnected)
+	if c.SessionID == sessionID {
+		t.Error("expected a new session")
+	}
+	if err = ackTx.CommitTransaction(); !errors.Is(err, ErrTransactionLost) {
+		t.Error(err)
+	}
+	select {
+	case m := <-queued.Messages():
+		if string(m.Body) != "acked" {
+			t.Error(string(m.Body))
+		}
+		if err = m.Ack(); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the redelivery")
+	}
+
+	// The transaction is renewed with its messages
+	if err = tx.CommitTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-messages:
+		if body != "in-tx" {
+			t.Error(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for message")
+	}
+
+	// The subscription is renewed
+	if err = c.SendWithReceipt(ctx, dest, []byte("again"), "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-messages:
+		if body != "again" {
+			t.Error(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for message")
+	}
+
+	if err = c.Disconnect(); err != nil {
+		t.Error(err)
+	}
+	expectState(StateClosed)
+}
+
+// fakeBroker accepts the connections on l, answers the CONNECT with CONNECTED and hands each connection to serve. It
+// returns the count of the accepted connections.
+func fakeBroker(l net.Listener, serve func(n int, conn net.Conn)) *int32 {
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n := int(atomic.AddInt32(&accepted, 1))
+			go func() {
+				defer func() { _ = conn.Close() }()
+				frames := frameScanner(conn)
+				<-frames
+				_, _ = conn.Write(NewFrame(CmdConnected, map[Header]string{
+					HdrKeyVersion: supportedVersion,
+					HdrKeySession: "fake-" + strconv.Itoa(n),
+				}, nil).Serialize())
+				serve(n, conn)
+				for range frames {
+				}
+			}()
+		}
+	}()
+	return &accepted
+}
+
+func TestReconnectBrokerError(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// The broker ends the connection with ERROR after CONNECTED
+	accepted := fakeBroker(l, func(n int, conn net.Conn) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = conn.Write(NewFrame(CmdError, map[Header]string{HdrKeyMessage: "Go away"}, nil).Serialize())
+		_ = conn.Close()
+	})
+
+	states := make(chan ConnectionState, 10)
+	closed := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err = Dial(ctx, TransportTCP, l.Addr().String(), &ClientOpts{
+		Reconnect: &ReconnectPolicy{InitialInterval: 10 * time.Millisecond},
+		OnStateChange: func(state ConnectionState, err error) {
+			states <- state
+			if state == StateClosed {
+				closed <- err
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-closed:
+		if !strings.Contains(err.Error(), "Go away") {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the close event")
+	}
+	if state := <-states; state != StateClosed {
+		t.Error("state:", state)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Error("connections:", n)
+	}
+}
+
+func TestReconnectBackOff(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// The broker drops every connection after the first one right after CONNECTED
+	accepted := fakeBroker(l, func(n int, conn net.Conn) {
+		if n > 1 {
+			_ = conn.Close()
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, TransportTCP, l.Addr().String(), &ClientOpts{
+		Reconnect: &ReconnectPolicy{InitialInterval: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.getConn().Close()
+
+	// The attempts back off though each one gets connected
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(accepted); n < 3 || n > 15 {
+		t.Error("connections:", n)
+	}
+	_ = c.Disconnect()
+}
+
+func TestConnectRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// The broker answers every CONNECT with ERROR, in its own wording
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			<-frameScanner(conn)
+			_, _ = conn.Write(NewFrame(CmdError, map[Header]string{HdrKeyMessage: "Bad credentials"}, nil).Serialize())
+			_ = conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := &ClientOpts{Login: "admin", Passcode: "wrong"}
+	if _, err = Dial(ctx, TransportTCP, l.Addr().String(), opts); !errors.Is(err, ErrAuthentication) {
+		t.Error(err)
+	}
+	if _, err = Dial(ctx, TransportTCP, l.Addr().String(), nil); !errors.Is(err, ErrConnectFailed) ||
+		errors.Is(err, ErrAuthentication) {
+		t.Error(err)
+	}
+}
+
+func TestSubscriptionMessages(t *testing.T) {
+	global := make(chan string, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, TransportTCP, "localhost:"+DefaultPort, &ClientOpts{
+		Login:          "admin",
+		Passcode:       "9a$$w0rd",
+		MessageHandler: func(message *UserMessage) { global <- string(message.Body) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Disconnect() }()
+
+	handled := make(chan string, 10)
+	if _, err = c.Subscribe("/topic/handler", HdrValAckAuto, WithReceipt(ctx),
+		WithHandler(func(message *UserMessage) { handled <- string(message.Body) })); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := c.Subscribe("/topic/channel", HdrValAckAuto, WithReceipt(ctx), WithMessages(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dest := range []string{"/topic/handler", "/topic/channel"} {
+		if err = c.SendWithReceipt(ctx, dest, []byte(dest), "text/plain", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case body := <-handled:
+		if body != "/topic/handler" {
+			t.Error(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the handler")
+	}
+	select {
+	case m := <-subs.Messages():
+		if string(m.Body) != "/topic/channel" {
+			t.Error(string(m.Body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the channel")
+	}
+	select {
+	case body := <-global:
+		t.Error("unexpected message for the client handler:", body)
+	default:
+	}
+
+	// The channel is closed on Unsubscribe
+	if err = subs.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-subs.Messages():
+		if ok {
+			t.Error("unexpected message after Unsubscribe")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("channel not closed on Unsubscribe")
+	}
+
+	// The channel is closed on Disconnect, even with the reading paused on the full buffer
+	if subs, err = c.Subscribe("/topic/channel", HdrValAckAuto, WithReceipt(ctx), WithMessages(1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = c.Send("/topic/channel", []byte("full"), "text/plain", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err = c.Disconnect(); err != nil {
+		t.Error(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for range subs.Messages() {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("channel not closed on Disconnect")
+	}
+}
+
+func TestAckNack(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, TransportTCP, "localhost:"+DefaultPort, &ClientOpts{Login: "admin", Passcode: "9a$$w0rd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Disconnect() }()
+	reg := tcp.(*tcpBroker).reg
+
+	receive := func(subs *Subscription) *UserMessage {
+		select {
+		case m := <-subs.Messages():
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+		return nil
+	}
+	expectPending := func(subs *Subscription, want uint64) {
+		info, err := reg.getSubsInfo(sessionKey(c.SessionID), subs.SubsID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); info.pendingCount() != want; {
+			if time.Now().After(deadline) {
+				t.Fatal("pending:", info.pendingCount(), "expected:", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	send := func(dest string, n int) {
+		for i := 0; i < n; i++ {
+			if err := c.SendWithReceipt(ctx, dest, []byte(strconv.Itoa(i)), "text/plain", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// client-individual: each message is settled on its own, the rejected one is redelivered
+	dest := "/queue/ack-individual"
+	subs, err := c.Subscribe(dest, HdrValAckClientIndividual, WithReceipt(ctx), WithMessages(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(dest, 2)
+	first, second := receive(subs), receive(subs)
+	expectPending(subs, 2)
+	if err = second.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(subs, 1)
+	if err = first.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	again := receive(subs)
+	if string(again.Body) != string(first.Body) || again.Headers[string(HdrKeyRedeliveryCount)] != "1" {
+		t.Error("unexpected redelivery:", string(again.Body), again.Headers)
+	}
+	tx, err := c.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Ack(again); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.CommitTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(subs, 0)
+
+	// client: the acknowledgement is cumulative
+	dest = "/queue/ack-client"
+	subs, err = c.Subscribe(dest, HdrValAckClient, WithReceipt(ctx), WithMessages(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(dest, 3)
+	_, _, last := receive(subs), receive(subs), receive(subs)
+	expectPending(subs, 3)
+	if err = last.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(subs, 0)
+
+	// auto: nothing to acknowledge
+	dest = "/queue/ack-auto"
+	subs, err = c.Subscribe(dest, HdrValAckAuto, WithReceipt(ctx), WithMessages(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(dest, 1)
+	if err = receive(subs).Ack(); err == nil {
+		t.Error("expected error acknowledging in auto mode")
+	}
+
+	// The prefetch limit is passed to the broker
+	subs, err = c.Subscribe("/queue/ack-prefetch", HdrValAckClient, WithReceipt(ctx), WithPrefetch(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := reg.getSubsInfo(sessionKey(c.SessionID), subs.SubsID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.prefetch != 2 {
+		t.Error("prefetch:", info.prefetch)
+	}
+}
+
 func customTestHeader(id int) map[string]string {
 	return map[string]string{
 		"testValidateID": strconv.Itoa(id),
@@ -214,6 +861,11 @@ func validateCustomTestHeader(h map[string]string, id int) error {
 	return fmt.Errorf("Missing testValidateID: %d, headers=%v\n", id, h)
 }
 
+// sessionKey returns the ID the broker keys the session by, from the `session` header prefixed by the principal
+func sessionKey(sessionID string) string {
+	return sessionID[strings.LastIndex(sessionID, "@")+1:]
+}
+
 func TestMain(m *testing.M) {
 	loginFunc := func(login, passcode string) error {
 		if login == "admin" && passcode == "9a$$w0rd" {
@@ -258,5 +910,7 @@ func TestMain(m *testing.M) {
 	<-ready
 
 	ret := m.Run()
+	tcp.Shutdown()
+	wss.Shutdown()
 	os.Exit(ret)
 }
@@ -1,15 +1,18 @@
 package stomp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff"
-	"github.com/go-co-op/gocron"
 	"github.com/google/uuid"
 )
 
@@ -22,6 +25,9 @@ const (
 type UserMessage struct {
 	Headers map[string]string // STOMP and custom headers received in MESSAGE
 	Body    []byte            // MESSAGE payload
+	c       *ClientHandler
+	ackID   string // Value of the `ack` header, set for the `client` and `client-individual` modes
+	gen     uint64 // Connection the message was received on
 }
 
 // Subscription represents the state of subscription
@@ -30,12 +36,23 @@ type Subscription struct {
 	SubsID      string
 	Destination string
 	ackMode     AckMode
+	selector    string
+	prefetch    int                // Cap on the unacknowledged messages, if >= 0
+	handler     MessageHandlerFunc // Handles the messages of this subscription, if set
+	msgCh       chan *UserMessage  // Delivers the messages of this subscription, if set
+	msgMu       sync.Mutex         // Guards msgCh against closing while delivering
+	closed      bool               // Set once msgCh is closed
+	done        chan struct{}      // Closed on Unsubscribe, to release a blocked delivery
+	doneOnce    sync.Once
 }
 
 // Transaction represents the state of transaction
 type Transaction struct {
-	c    *ClientHandler
-	TxID string
+	c      *ClientHandler
+	TxID   string
+	gen    uint64   // Connection the transaction is open on
+	frames []*Frame // SEND frames of the transaction, sent anew when it is recovered on reconnect
+	acked  bool     // Set once the transaction holds an ACK/NACK, which cannot be recovered on reconnect
 }
 
 // MessageHandlerFunc is the function-type for user-defined function to handle the messages
@@ -45,22 +62,40 @@ type MessageHandlerFunc func(message *UserMessage)
 type ClientHandler struct {
 	SessionID      string                   // Session ID for the connection with the STOMP Broker
 	conn           net.Conn                 // Connection to the server/broker
+	connMu         sync.Mutex               // Guards conn, hb, gen, ready, closing, the losses and the redialing state
+	gen            uint64                   // Incremented on each new connection
+	ready          bool                     // Connected and subscribed, a loss of the connection is to be handled
+	closing        bool                     // Disconnect is requested, the connection is not to be recovered
+	brokerErr      error                    // ERROR received from the broker, the connection is not to be recovered
+	lostErr        error                    // Loss of the connection before it got ready
+	readyAt        time.Time                // When the connection got ready
+	redialBackOff  backoff.BackOff          // Backoff of the reconnect attempts, carried on over the short connections
+	transport      Transport                // Transport to the broker, for reconnecting
+	brokerHost     string                   // Host of the broker, for reconnecting
+	brokerPort     string                   // Port of the broker, for reconnecting
+	tlsConfig      *tls.Config              // TLS for the transport, for reconnecting
+	useStompCmd    bool                     // Connect with STOMP instead of CONNECT
+	reconnect      *ReconnectPolicy         // Nil if not reconnecting
+	onStateChange  StateChangeFunc          // Callback notified of the connection state changes
 	host           string                   // Virtual-host on the STOMP broker
 	login          string                   // Username for the login to STOMP broker
 	passcode       string                   // Password to log in to the STOMP broker
-	hbSendInterval int                      // Send-interval in milliseconds from client
-	hbRecvInterval int                      // Receive-interval in milliseconds on client
-	hbJob          *gocron.Job              // Heartbeat sending job
+	hbSendInterval int                      // Send-interval in milliseconds from client, as configured
+	hbRecvInterval int                      // Receive-interval in milliseconds on client, as configured
+	hb             *heartbeater             // Sends heartbeats over conn
+	hbGrace        int                      // Margin in milliseconds for the broker's heartbeats
+	reader         *readTracker             // Reads from conn, tracking the broker's liveness
 	msgHandler     MessageHandlerFunc       // Callback to process the MESSAGE
 	subsMap        map[string]*Subscription // Subscription ID to Subscription map
-	ackCh          chan *ackData            // Channel to signal ackHandler
-}
-
-type ackData struct {
-	subsID  string
-	ackID   string
-	txID    string
-	ackMode AckMode
+	subsMu         sync.Mutex               // Guards subsMap
+	txMap          map[string]*Transaction  // Transaction ID to the transaction in progress
+	txMu           sync.Mutex               // Guards txMap and the transactions in it
+	receipts       map[string]chan error    // Receipt ID to the channel of the caller waiting for RECEIPT
+	receiptsMu     sync.Mutex               // Guards receipts
+	connected      chan error               // Outcome of the CONNECT: nil on CONNECTED, else the error
+	handshaking    bool                     // CONNECT sent and CONNECTED awaited, used by the read loop only
+	connectTimeout time.Duration            // Wait for CONNECTED in Connect
+	sessionInfo    SessionInfo              // Negotiated by CONNECTED
 }
 
 // ClientOpts provides the options as argument to NewClientHandler
@@ -71,43 +106,111 @@ type ClientOpts struct {
 	HeartbeatSendInterval    int                // Sending interval of heartbeats in milliseconds
 	HeartbeatReceiveInterval int                // Receiving interval of heartbeats in milliseconds
 	MessageHandler           MessageHandlerFunc // User-defined callback function to handle MESSAGE
+	TLSConfig                *tls.Config        // TLS for the transport, with the client certificate for mutual TLS
+	ConnectTimeout           time.Duration      // Wait for CONNECTED in Connect. Default: 10s (DefaultConnectTimeout)
+	HeartbeatGrace           int                // Margin in milliseconds for the broker's heartbeats. Default: 1000
+	Reconnect                *ReconnectPolicy   // Reconnect when the connection is lost. Default: nil (no reconnect)
+	OnStateChange            StateChangeFunc    // User-defined callback notified of the connection state changes
 }
 
-// NewClientHandler creates the Client for STOMP
-func NewClientHandler(transport Transport, host, port string, opts *ClientOpts) *ClientHandler {
-	var conn net.Conn
-	var err error
+// SessionInfo describes the session established with the broker, as negotiated by CONNECT/CONNECTED
+type SessionInfo struct {
+	SessionID                string // Session ID assigned by the broker
+	Version                  string // Version of the STOMP protocol
+	Server                   string // Name and version of the broker
+	HeartbeatSendInterval    int    // Sending interval of heartbeats in milliseconds, 0 if none are sent
+	HeartbeatReceiveInterval int    // Receiving interval of heartbeats in milliseconds, 0 if none are expected
+}
 
-	switch transport {
-	case TransportTCP:
-		conn, err = startTcpClient(host, port)
-	case TransportWebsocket:
-		conn, err = startWebsocketClient(host, port)
-	default:
-		log.Fatal("Invalid transport:", transport, ". Expected:", TransportTCP, "or", TransportWebsocket)
+// NewClientHandler creates the Client for STOMP. It exits the process if the connection fails, use Dial to handle
+// the errors instead.
+func NewClientHandler(transport Transport, host, port string, opts *ClientOpts) *ClientHandler {
+	if opts == nil {
+		opts = &ClientOpts{}
 	}
+	conn, err := dialTransport(context.Background(), transport, host, port, opts.TLSConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return newClientHandler(conn, transport, host, port, opts)
+}
 
+// Dial connects to the broker at addr (host:port) and completes the CONNECT/CONNECTED handshake. The ctx bounds the
+// dialing and the handshake, on expiry the returned error matches ctx.Err(). The other errors match
+// ErrInvalidTransport, ErrDialFailed, ErrConnectFailed or ErrAuthentication.
+func Dial(ctx context.Context, transport Transport, addr string, opts *ClientOpts) (*ClientHandler, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errorWrap(errInvalidArg, ErrDialFailed, err.Error())
+	}
 	if opts == nil {
 		opts = &ClientOpts{}
 	}
 
-	if opts.VirtualHost == "" {
-		opts.VirtualHost = conn.RemoteAddr().String()
+	conn, err := dialTransport(ctx, transport, host, port, opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := newClientHandler(conn, transport, host, port, opts)
+	if _, err = c.handshake(ctx, false); err != nil {
+		return nil, err
+	}
+	if _, err = c.setReady(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialTransport opens the connection to the broker over the transport
+func dialTransport(ctx context.Context, transport Transport, host, port string, tlsConfig *tls.Config,
+) (net.Conn, error) {
+	switch transport {
+	case TransportTCP:
+		return startTcpClient(ctx, host, port, tlsConfig)
+	case TransportWebsocket:
+		return startWebsocketClient(ctx, host, port, tlsConfig)
+	}
+	return nil, errorWrap(errInvalidArg, ErrInvalidTransport,
+		fmt.Sprint(transport, ", expected: ", TransportTCP, " or ", TransportWebsocket))
+}
+
+func newClientHandler(conn net.Conn, transport Transport, brokerHost, brokerPort string,
+	opts *ClientOpts,
+) *ClientHandler {
+	host := opts.VirtualHost
+	if host == "" {
+		host = conn.RemoteAddr().String()
+	}
+	connectTimeout := opts.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	hbGrace := opts.HeartbeatGrace
+	if hbGrace <= 0 {
+		hbGrace = DefaultHeartbeatGraceMsec
 	}
 
 	return &ClientHandler{
 		conn:           conn,
-		host:           opts.VirtualHost,
+		hb:             newHeartbeater(),
+		transport:      transport,
+		brokerHost:     brokerHost,
+		brokerPort:     brokerPort,
+		tlsConfig:      opts.TLSConfig,
+		reconnect:      opts.Reconnect,
+		onStateChange:  opts.OnStateChange,
+		host:           host,
 		login:          opts.Login,
 		passcode:       opts.Passcode,
 		hbSendInterval: opts.HeartbeatSendInterval,
 		hbRecvInterval: opts.HeartbeatReceiveInterval,
 		msgHandler:     opts.MessageHandler,
-		ackCh:          make(chan *ackData, 100),
 		subsMap:        map[string]*Subscription{},
+		txMap:          map[string]*Transaction{},
+		receipts:       map[string]chan error{},
+		connected:      make(chan error, 1),
+		connectTimeout: connectTimeout,
+		hbGrace:        hbGrace,
 	}
 }
 
@@ -116,15 +219,89 @@ func (c *ClientHandler) SetMessageHandler(handlerFunc MessageHandlerFunc) {
 	c.msgHandler = handlerFunc
 }
 
-// Connect connects with the broker and starts listening to the messages from broker
-func (c *ClientHandler) Connect(useStompCmd bool) error {
+// handshake connects with the broker and waits for the CONNECTED, or the ERROR, until the ctx is done. The connection
+// is closed on failure.
+func (c *ClientHandler) handshake(ctx context.Context, useStompCmd bool) (*SessionInfo, error) {
+	conn := c.getConn()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+		defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+	}
+
+	c.useStompCmd = useStompCmd
+	c.connected = make(chan error, 1)
+	c.connMu.Lock()
+	c.brokerErr, c.lostErr = nil, nil
+	c.connMu.Unlock()
+	err := c.start(conn, useStompCmd)
+	if err != nil {
+		err = errorWrap(errNetwork, ErrConnectFailed, err.Error())
+	} else {
+		select {
+		case err = <-c.connected:
+		case <-ctx.Done():
+			err = errorWrap(errNetwork, ctx.Err(), "Waiting for CONNECTED")
+		}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	info := c.sessionInfo
+	return &info, nil
+}
+
+func (c *ClientHandler) getConn() net.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
+func (c *ClientHandler) heartbeater() *heartbeater {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.hb
+}
+
+// signalConnected reports the outcome of the CONNECT, only the first one counts
+func (c *ClientHandler) signalConnected(err error) {
+	select {
+	case c.connected <- err:
+	default:
+	}
+}
+
+// Connect connects with the broker and starts listening to the messages from broker. It waits for the broker to
+// accept the connection with CONNECTED, up to the ConnectTimeout, and returns the negotiated session. The returned
+// error matches ErrAuthentication if the broker rejected the credentials: an ERROR answers the CONNECT carrying the
+// login or the passcode, or else its message reports an authentication error as this broker's does.
+func (c *ClientHandler) Connect(useStompCmd bool) (*SessionInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.connectTimeout)
+	defer cancel()
+	info, err := c.handshake(ctx, useStompCmd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.setReady(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// start sends the CONNECT and starts listening to the messages from broker over the conn
+func (c *ClientHandler) start(conn net.Conn, useStompCmd bool) error {
+	hb := newHeartbeater()
+	c.connMu.Lock()
+	c.hb = hb
+	c.connMu.Unlock()
 	if err := c.connect(useStompCmd); err != nil {
 		return err
 	}
 
-	// go c.ackHandler()
-	go func() {
-		for raw := range frameScanner(c.conn) {
+	c.reader = newReadTracker(conn)
+	c.handshaking = true
+	go func(reader *readTracker) {
+		for raw := range frameScanner(reader) {
 			frame, err := NewFrameFromBytes(raw)
 			if err != nil {
 				log.Println(err)
@@ -141,10 +318,15 @@ func (c *ClientHandler) Connect(useStompCmd bool) error {
 		}
 
 		// Cleanup
-		if c.hbJob != nil {
-			sched.RemoveByReference(c.hbJob)
+		reader.stop()
+		c.signalConnected(errorWrap(errNetwork, ErrConnectFailed, "Connection closed"))
+		hb.stop()
+		cause := conn.RemoteAddr().String()
+		if reader.isExpired() {
+			cause = "No heartbeat from the broker at " + cause
 		}
-	}()
+		c.connectionLost(conn, errorWrap(errNetwork, ErrConnectionLost, cause))
+	}(c.reader)
 	return nil
 }
 
@@ -152,9 +334,12 @@ func (c *ClientHandler) Connect(useStompCmd bool) error {
 func (c *ClientHandler) stateMachine(frame *Frame) error {
 	switch frame.command {
 	case CmdConnected:
+		c.handshaking = false
 		if err := c.handleConnected(frame); err != nil {
+			c.signalConnected(errorWrap(errClientStateMachine, ErrConnectFailed, err.Error()))
 			return err
 		}
+		c.signalConnected(nil)
 
 	case CmdMessage:
 		if err := c.handleMessage(frame); err != nil {
@@ -162,16 +347,33 @@ func (c *ClientHandler) stateMachine(frame *Frame) error {
 		}
 
 	case CmdReceipt:
-		if frame.getHeader(HdrKeyReceiptID) == disconnectID {
-			_ = c.conn.Close()
+		receiptID := frame.getHeader(HdrKeyReceiptID)
+		if receiptID == disconnectID {
+			_ = c.getConn().Close()
 			return errors.New("bye") // Returning error will close the connection
 		}
+		c.notifyReceipt(receiptID, nil)
 
 	case CmdError:
 		log.Println("Received error:", frame)
-		if err := c.Disconnect(); err != nil {
-			return err
+		// An ERROR in answer to the CONNECT carrying the credentials rejects them, whatever the broker's wording
+		connectErr := ErrConnectFailed
+		if c.handshaking && (c.login != "" || c.passcode != "" ||
+			strings.Contains(frame.getHeader(HdrKeyMessage), string(errAuthentication))) {
+			connectErr = ErrAuthentication
+		}
+		err := errorWrap(errClientStateMachine, connectErr, "Broker error: "+frame.getHeader(HdrKeyMessage))
+		c.signalConnected(err)
+		if receiptID := frame.getHeader(HdrKeyReceiptID); receiptID != "" {
+			c.notifyReceipt(receiptID, errorMsg(errClientStateMachine,
+				"Broker error: "+frame.getHeader(HdrKeyMessage)))
 		}
+		// The broker closes the connection after the ERROR, reconnecting would only get the same ERROR again
+		c.connMu.Lock()
+		c.brokerErr = err
+		c.connMu.Unlock()
+		_ = c.getConn().Close()
+		return err
 	}
 	return nil
 }
@@ -181,42 +383,51 @@ func (c *ClientHandler) handleConnected(frame *Frame) error {
 	if c.SessionID == "" {
 		return errorMsg(errClientStateMachine, "Missing session ID in connection")
 	}
+	// No heartbeats without the broker agreeing on them
+	sendInterval, recvInterval := 0, 0
 	if hbVal := frame.getHeader(HdrKeyHeartBeat); hbVal != "" {
-		if err := c.negotiateHeartbeats(hbVal); err != nil {
+		var err error
+		if sendInterval, recvInterval, err = c.negotiateHeartbeats(hbVal); err != nil {
 			return err
 		}
 	}
-	return nil
-}
 
-func (c *ClientHandler) handleMessage(frame *Frame) error {
-	if c.msgHandler != nil {
-		c.msgHandler(c.getUserMessage(frame))
-	}
-	if frame.getHeader(HdrKeyAck) == "" {
-		return nil
-	}
-	subsID := frame.getHeader(HdrKeySubscription)
-	if _, ok := c.subsMap[subsID]; !ok {
-		log.Println("Subscription ID in message:", subsID, "not found in c.subsMap")
-		return nil
+	// Liveness of the broker, it is dead if not even a heartbeat arrives within the interval and the grace
+	if recvInterval > 0 {
+		conn := c.getConn()
+		c.reader.watch(time.Duration(recvInterval+c.hbGrace)*time.Millisecond, func() {
+			log.Println("No heartbeat from the broker, closing the connection")
+			_ = conn.Close()
+		})
 	}
-	subs := c.subsMap[subsID]
 
-	// Client Individual Ack
-	if subs.ackMode == HdrValAckClientIndividual {
-		if err := c.sendAck(frame.getHeader(HdrKeyAck), frame.getHeader(HdrKeyTransaction)); err != nil {
-			log.Println(err)
-		}
-		return nil
+	c.sessionInfo = SessionInfo{
+		SessionID:                c.SessionID,
+		Version:                  frame.getHeader(HdrKeyVersion),
+		Server:                   frame.getHeader(HdrKeyServer),
+		HeartbeatSendInterval:    sendInterval,
+		HeartbeatReceiveInterval: recvInterval,
 	}
+	return nil
+}
 
-	// Client Ack
-	c.ackCh <- &ackData{
-		subsID:  subs.SubsID,
-		ackID:   frame.getHeader(HdrKeyAck),
-		txID:    frame.getHeader(HdrKeyTransaction),
-		ackMode: subs.ackMode,
+func (c *ClientHandler) handleMessage(frame *Frame) error {
+	subsID := frame.getHeader(HdrKeySubscription)
+	c.subsMu.Lock()
+	subs, ok := c.subsMap[subsID]
+	c.subsMu.Unlock()
+
+	m := c.getUserMessage(frame)
+	if ok && subs.ackMode != HdrValAckAuto {
+		m.ackID = frame.getHeader(HdrKeyAck)
+	}
+	switch {
+	case ok && subs.handler != nil:
+		subs.handler(m)
+	case ok && subs.msgCh != nil:
+		subs.deliver(m, c.reader)
+	case c.msgHandler != nil:
+		c.msgHandler(m)
 	}
 	return nil
 }
@@ -228,9 +439,10 @@ func (c *ClientHandler) send(cmd Command, headers map[Header]string, body []byte
 	}
 
 	sendIt := func() error {
-		if _, err := c.conn.Write(f.Serialize()); err != nil {
+		if _, err := c.getConn().Write(f.Serialize()); err != nil {
 			return err
 		}
+		c.heartbeater().wrote()
 		return nil
 	}
 	b := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 3)
@@ -241,9 +453,50 @@ func (c *ClientHandler) send(cmd Command, headers map[Header]string, body []byte
 	return nil
 }
 
+// sendWithReceipt sends the frame asking for a receipt, and waits until the broker responds with RECEIPT, with ERROR
+// or the ctx is done
+func (c *ClientHandler) sendWithReceipt(ctx context.Context, cmd Command, headers map[Header]string,
+	body []byte,
+) error {
+	receiptID := uuid.NewString()
+	ch := make(chan error, 1)
+	c.receiptsMu.Lock()
+	c.receipts[receiptID] = ch
+	c.receiptsMu.Unlock()
+	defer func() {
+		c.receiptsMu.Lock()
+		delete(c.receipts, receiptID)
+		c.receiptsMu.Unlock()
+	}()
+
+	headers[HdrKeyReceipt] = receiptID
+	if err := c.send(cmd, headers, body); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyReceipt wakes up the caller waiting for the receipt, unless it has been woken up already
+func (c *ClientHandler) notifyReceipt(receiptID string, err error) {
+	c.receiptsMu.Lock()
+	defer c.receiptsMu.Unlock()
+	if ch, ok := c.receipts[receiptID]; ok {
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+}
+
 func (c *ClientHandler) sendRaw(body []byte) error {
 	sendIt := func() error {
-		if _, err := c.conn.Write(body); err != nil {
+		if _, err := c.getConn().Write(body); err != nil {
 			return err
 		}
 		return nil
@@ -257,38 +510,35 @@ func (c *ClientHandler) sendRaw(body []byte) error {
 	return nil
 }
 
-func (c *ClientHandler) negotiateHeartbeats(hbVal string) error {
+// negotiateHeartbeats returns the intervals agreed with the broker for the connection, starting from the configured
+// ones so that every reconnect negotiates them anew
+func (c *ClientHandler) negotiateHeartbeats(hbVal string) (sendInterval, recvInterval int, err error) {
 	brokerSendInterval, brokerRecvInterval, err := parseHbVal(hbVal)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	// Send-HB negotiation
-	if brokerSendInterval == 0 || c.hbRecvInterval == 0 {
-		c.hbRecvInterval = 0
-	} else if brokerSendInterval > c.hbRecvInterval {
-		c.hbRecvInterval = brokerSendInterval
+	recvInterval = c.hbRecvInterval
+	if brokerSendInterval == 0 || recvInterval == 0 {
+		recvInterval = 0
+	} else if brokerSendInterval > recvInterval {
+		recvInterval = brokerSendInterval
 	}
 
 	// Receive-HB negotiation
-	if brokerRecvInterval == 0 || c.hbSendInterval == 0 {
-		c.hbSendInterval = 0
-		return nil // no heartbeats to be sent
-	} else if brokerRecvInterval > c.hbSendInterval {
-		c.hbSendInterval = brokerRecvInterval
-	}
-
-	// Schedule sending heartbeats by hbSendInterval
-	c.hbJob, err = sched.Every(c.hbSendInterval).Milliseconds().Tag(c.SessionID).Do(
-		func() {
-			_ = c.sendRaw([]byte("\n"))
-		})
-	if err != nil {
-		return errorMsg(errClientStateMachine, "Heartbeat setup error: "+err.Error())
-	}
-	sched.StartAsync()
-
-	return nil
+	sendInterval = c.hbSendInterval
+	if brokerRecvInterval == 0 || sendInterval == 0 {
+		return 0, recvInterval, nil // no heartbeats to be sent
+	} else if brokerRecvInterval > sendInterval {
+		sendInterval = brokerRecvInterval
+	}
+
+	// Send heartbeats by sendInterval
+	c.heartbeater().start(time.Duration(sendInterval)*time.Millisecond, func() error {
+		return c.sendRaw([]byte("\n"))
+	})
+	return sendInterval, recvInterval, nil
 }
 
 func (c *ClientHandler) getUserMessage(f *Frame) *UserMessage {
@@ -299,12 +549,41 @@ func (c *ClientHandler) getUserMessage(f *Frame) *UserMessage {
 	return &UserMessage{
 		Headers: userHeaders,
 		Body:    f.body,
+		c:       c,
+		gen:     c.connGen(),
+	}
+}
+
+// Ack acknowledges the message as processed, for the subscriptions in the `client` and `client-individual` modes.
+// In the `client` mode the acknowledgement is cumulative: it covers all the messages of the subscription received
+// before this one too.
+func (m *UserMessage) Ack() error {
+	return m.ack(CmdAck, "")
+}
+
+// Nack rejects the message, for the subscriptions in the `client` and `client-individual` modes. The broker
+// redelivers the rejected message(s). In the `client` mode it is cumulative like Ack.
+func (m *UserMessage) Nack() error {
+	return m.ack(CmdNack, "")
+}
+
+func (m *UserMessage) ack(cmd Command, txID string) error {
+	if m.ackID == "" {
+		return errorMsg(errProtocolFrame, "No acknowledgement expected for the message")
+	}
+	if m.gen != m.c.connGen() {
+		return errorWrap(errNetwork, ErrConnectionLost, "Message received on the previous connection")
+	}
+	h := map[Header]string{HdrKeyID: m.ackID}
+	if txID != "" {
+		h[HdrKeyTransaction] = txID
 	}
+	return m.c.send(cmd, h, nil)
 }
 
 func (c *ClientHandler) connect(useStomp bool) error {
 	headers := map[Header]string{
-		HdrKeyAcceptVersion: "1.2",
+		HdrKeyAcceptVersion: supportedVersion,
 		HdrKeyHost:          c.host,
 	}
 	if c.login != "" {
@@ -322,7 +601,7 @@ func (c *ClientHandler) connect(useStomp bool) error {
 	return c.send(cmd, headers, nil)
 }
 
-func (c *ClientHandler) Send(dest string, body []byte, contentType string, customHeaders map[string]string) error {
+func sendHeaders(dest string, body []byte, contentType string, customHeaders map[string]string) map[Header]string {
 	h := map[Header]string{
 		HdrKeyDestination:   dest,
 		HdrKeyContentType:   contentType,
@@ -331,112 +610,301 @@ func (c *ClientHandler) Send(dest string, body []byte, contentType string, custo
 	for k, v := range customHeaders {
 		h[Header(k)] = v
 	}
-	return c.send(CmdSend, h, body)
+	return h
+}
+
+func (c *ClientHandler) Send(dest string, body []byte, contentType string, customHeaders map[string]string) error {
+	return c.send(CmdSend, sendHeaders(dest, body, contentType, customHeaders), body)
+}
+
+// SendWithReceipt sends the message and blocks until the broker confirms it with RECEIPT, or the ctx is done
+func (c *ClientHandler) SendWithReceipt(ctx context.Context, dest string, body []byte, contentType string,
+	customHeaders map[string]string,
+) error {
+	return c.sendWithReceipt(ctx, CmdSend, sendHeaders(dest, body, contentType, customHeaders), body)
 }
 
+// Disconnect closes the connection with the broker, the connection is not recovered after it. The Messages channels
+// of the subscriptions are closed.
 func (c *ClientHandler) Disconnect() error {
+	c.connMu.Lock()
+	c.closing = true
+	c.connMu.Unlock()
+	c.closeMessages()
+	return c.disconnect()
+}
+
+func (c *ClientHandler) disconnect() error {
 	return c.send(CmdDisconnect, map[Header]string{HdrKeyReceipt: disconnectID}, nil)
 }
 
-func (c *ClientHandler) Subscribe(dest string, mode AckMode) (*Subscription, error) {
-	subID := uuid.NewString()
+// SubscribeOption configures the optional behaviour of Subscribe
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	receiptCtx context.Context    // Wait for RECEIPT if set
+	selector   string             // Filter applied by the broker, if set
+	handler    MessageHandlerFunc // Handler of the subscription's messages, if set
+	msgBuffer  int                // Buffer of the Messages channel, if >= 0
+	prefetch   int                // Cap on the unacknowledged messages, if >= 0
+}
+
+// WithReceipt makes Subscribe block until the broker confirms the subscription with RECEIPT, or the ctx is done
+func WithReceipt(ctx context.Context) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.receiptCtx = ctx
+	}
+}
+
+// WithHandler makes the handlerFunc handle the messages of the subscription, instead of the MessageHandler of the
+// client
+func WithHandler(handlerFunc MessageHandlerFunc) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.handler = handlerFunc
+	}
+}
+
+// WithMessages makes the messages of the subscription available on its Messages channel with the buffer size,
+// instead of the MessageHandler of the client. The reading of the messages from the broker is paused while the
+// buffer is full, for all the subscriptions of the client, and the broker's heartbeats are not checked meanwhile.
+func WithMessages(bufferSize int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.msgBuffer = bufferSize
+	}
+}
+
+// WithPrefetch caps the messages the broker delivers to the subscription before they are acknowledged, for the
+// `client` and `client-individual` modes. The size 0 lifts the broker's default limit.
+func WithPrefetch(size int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.prefetch = size
+	}
+}
+
+// WithSelector makes the broker deliver only the messages whose headers satisfy the SQL-92-like expression,
+// e.g. `priority > 5 AND region = 'eu'`
+func WithSelector(expr string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.selector = expr
+	}
+}
+
+func (c *ClientHandler) Subscribe(dest string, mode AckMode, opts ...SubscribeOption) (*Subscription, error) {
+	cfg := &subscribeConfig{msgBuffer: -1, prefetch: -1}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
 	if mode == "" {
 		mode = HdrValAckAuto
 	}
-
-	h := map[Header]string{
-		HdrKeyID:          subID,
-		HdrKeyDestination: dest,
-		HdrKeyAck:         string(mode),
+	subs := &Subscription{
+		c:           c,
+		SubsID:      uuid.NewString(),
+		Destination: dest,
+		ackMode:     mode,
+		selector:    cfg.selector,
+		prefetch:    cfg.prefetch,
+		handler:     cfg.handler,
+		done:        make(chan struct{}),
+	}
+	if cfg.msgBuffer >= 0 {
+		subs.msgCh = make(chan *UserMessage, cfg.msgBuffer)
 	}
 
-	if err := c.send(CmdSubscribe, h, nil); err != nil {
+	// Register before subscribing, the messages may arrive ahead of the receipt
+	c.subsMu.Lock()
+	c.subsMap[subs.SubsID] = subs
+	c.subsMu.Unlock()
+
+	var err error
+	if cfg.receiptCtx != nil {
+		err = c.sendWithReceipt(cfg.receiptCtx, CmdSubscribe, subs.headers(), nil)
+	} else {
+		err = c.send(CmdSubscribe, subs.headers(), nil)
+	}
+	if err != nil {
+		c.subsMu.Lock()
+		delete(c.subsMap, subs.SubsID)
+		c.subsMu.Unlock()
+		subs.closeMessages()
 		return nil, err
 	}
+	return subs, nil
+}
+
+// Messages returns the channel of the subscription's messages, created by the WithMessages option, nil otherwise.
+// The channel is closed on Unsubscribe, and once the connection is closed for good.
+func (s *Subscription) Messages() <-chan *UserMessage {
+	return s.msgCh
+}
+
+// deliver puts the message on the Messages channel, waiting for the room in the buffer unless unsubscribed. The
+// reader's watch of the broker's liveness is paused while waiting.
+func (s *Subscription) deliver(m *UserMessage, reader *readTracker) {
+	s.msgMu.Lock()
+	defer s.msgMu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.msgCh <- m:
+		return
+	default:
+	}
+	reader.stall()
+	defer reader.resume()
+	select {
+	case s.msgCh <- m:
+	case <-s.done:
+	}
+}
 
-	c.subsMap[subID] = &Subscription{c: c, SubsID: subID, Destination: dest, ackMode: mode}
-	return c.subsMap[subID], nil
+// closeMessages closes the Messages channel, once the delivery in progress is over
+func (s *Subscription) closeMessages() {
+	s.doneOnce.Do(func() { close(s.done) })
+	s.msgMu.Lock()
+	defer s.msgMu.Unlock()
+	if s.msgCh != nil && !s.closed {
+		s.closed = true
+		close(s.msgCh)
+	}
+}
+
+// headers returns the headers of the SUBSCRIBE frame for the subscription
+func (s *Subscription) headers() map[Header]string {
+	h := map[Header]string{
+		HdrKeyID:          s.SubsID,
+		HdrKeyDestination: s.Destination,
+		HdrKeyAck:         string(s.ackMode),
+	}
+	if s.selector != "" {
+		h[HdrKeySelector] = s.selector
+	}
+	if s.prefetch >= 0 {
+		h[HdrKeyPrefetchSize] = strconv.Itoa(s.prefetch)
+	}
+	return h
 }
 
 func (s *Subscription) Unsubscribe() error {
 	if err := s.c.send(CmdUnsubscribe, map[Header]string{HdrKeyID: s.SubsID}, nil); err != nil {
 		return err
 	}
+	s.c.subsMu.Lock()
+	delete(s.c.subsMap, s.SubsID)
+	s.c.subsMu.Unlock()
+	s.closeMessages()
 	return nil
 }
 
+// closeMessages closes the Messages channels of all the subscriptions
+func (c *ClientHandler) closeMessages() {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for _, subs := range c.subsMap {
+		subs.closeMessages()
+	}
+}
+
 func (c *ClientHandler) BeginTransaction() (*Transaction, error) {
 	txID := uuid.NewString()
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+	gen := c.connGen()
 	if err := c.send(CmdBegin, map[Header]string{HdrKeyTransaction: txID}, nil); err != nil {
 		return nil, err
 	}
-	return &Transaction{c: c, TxID: txID}, nil
+	t := &Transaction{c: c, TxID: txID, gen: gen}
+	c.txMap[txID] = t
+	return t, nil
+}
+
+// lost tells if the transaction is gone with the connection, or is yet to be recovered on the new one.
+// The caller must hold the txMu.
+func (t *Transaction) lost() error {
+	if _, ok := t.c.txMap[t.TxID]; !ok {
+		return errorWrap(errTransaction, ErrTransactionLost, t.TxID)
+	}
+	if t.gen != t.c.connGen() {
+		return errorWrap(errNetwork, ErrConnectionLost, "Transaction not recovered yet: "+t.TxID)
+	}
+	return nil
 }
 
 func (t *Transaction) Send(dest string, body []byte, contentType string, headers map[string]string) error {
-	if t.c == nil {
+	c := t.c
+	if c == nil {
 		return errorMsg(errProtocolFrame, "Send on closed transaction")
 	}
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+	if err := t.lost(); err != nil {
+		return err
+	}
 	hdr := map[string]string{}
 	for k, v := range headers {
 		hdr[strings.ToLower(k)] = v
 	}
 	hdr[string(HdrKeyTransaction)] = t.TxID
-	return t.c.Send(dest, body, contentType, hdr)
+	h := sendHeaders(dest, body, contentType, hdr)
+	if err := c.send(CmdSend, h, body); err != nil {
+		return err
+	}
+	t.frames = append(t.frames, NewFrame(CmdSend, h, body))
+	return nil
 }
 
-func (t *Transaction) AbortTransaction() error {
-	if t.c == nil {
-		return errorMsg(errProtocolFrame, "Abort on closed transaction")
+// Ack acknowledges the message as part of the transaction, it takes effect on commit
+func (t *Transaction) Ack(m *UserMessage) error {
+	return t.ack(CmdAck, m)
+}
+
+// Nack rejects the message as part of the transaction, it takes effect on commit
+func (t *Transaction) Nack(m *UserMessage) error {
+	return t.ack(CmdNack, m)
+}
+
+func (t *Transaction) ack(cmd Command, m *UserMessage) error {
+	c := t.c
+	if c == nil {
+		return errorMsg(errProtocolFrame, string(cmd)+" on closed transaction")
 	}
-	if err := t.c.send(CmdAbort, map[Header]string{HdrKeyTransaction: t.TxID}, nil); err != nil {
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+	if err := t.lost(); err != nil {
 		return err
 	}
-	t.c = nil
+	if err := m.ack(cmd, t.TxID); err != nil {
+		return err
+	}
+	t.acked = true
 	return nil
 }
 
+func (t *Transaction) AbortTransaction() error {
+	return t.end(CmdAbort)
+}
+
 func (t *Transaction) CommitTransaction() error {
-	if t.c == nil {
-		return errorMsg(errProtocolFrame, "Commit on closed transaction")
+	return t.end(CmdCommit)
+}
+
+// end commits or aborts the transaction
+func (t *Transaction) end(cmd Command) error {
+	c := t.c
+	if c == nil {
+		return errorMsg(errProtocolFrame, string(cmd)+" on closed transaction")
+	}
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+	if err := t.lost(); err != nil {
+		return err
 	}
-	if err := t.c.send(CmdCommit, map[Header]string{HdrKeyTransaction: t.TxID}, nil); err != nil {
+	if err := c.send(cmd, map[Header]string{HdrKeyTransaction: t.TxID}, nil); err != nil {
 		return err
 	}
+	delete(c.txMap, t.TxID)
 	t.c = nil
 	return nil
 }
-
-func (c *ClientHandler) sendAck(id string, txID string) error {
-	m := map[Header]string{HdrKeyID: id}
-	if txID != "" {
-		m[HdrKeyTransaction] = txID
-	}
-	return c.send(CmdAck, m, nil)
-}
-
-// func (c *ClientHandler) nack(id string, txID string) error {
-// 	m := map[Header]string{HdrKeyID: id}
-// 	if txID != "" {
-// 		m[HdrKeyTransaction] = txID
-// 	}
-// 	return c.send(CmdNack, m, nil)
-// }
-
-// func (c *ClientHandler) ackHandler() {
-// 	t := time.Tick(time.Second * 3)
-// 	m := map[string]*ackData{}
-// 	for {
-// 		select {
-// 		case d := <-c.ackCh:
-// 			m[d.subsID] = d
-// 		case <-t:
-// 			for _, d := range m {
-// 				if err := c.sendAck(d.ackID, d.txID); err != nil {
-// 					log.Println(err)
-// 				}
-// 			}
-// 			m = map[string]*ackData{}
-// 		}
-// 	}
-// }
@@ -10,12 +10,22 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/go-co-op/gocron"
 )
 
+// supportedVersion is the version of STOMP protocol implemented
+const supportedVersion = "1.2"
+
 const (
-	DefaultPort = "61613"
+	DefaultPort              = "61613"
+	DefaultMaxRedeliveries   = 5
+	DefaultDeadLetterPrefix  = "/dlq"
+	DefaultQueuePrefix       = "/queue/"
+	DefaultMaxHeldMessages   = 1000
+	DefaultOutboundQueueSize = 1000
+	DefaultMaxTxFrames       = 1000
+	DefaultConnectTimeout    = 10 * time.Second
+
+	DefaultHeartbeatGraceMsec = 1000
 )
 
 // Transport represents the underlying transporting protocol for STOMP
@@ -30,9 +40,6 @@ const (
 //go:embed version.txt
 var releaseVersion string
 
-// Scheduler for sending heartbeats
-var sched = gocron.NewScheduler(time.UTC)
-
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
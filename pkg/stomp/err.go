@@ -1,6 +1,7 @@
 package stomp
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -15,8 +16,27 @@ const (
 	errBrokerStateMachine stompErrorType = "Protocol (broker) state-machine error"
 	errClientStateMachine stompErrorType = "Protocol (client) state-machine error"
 	errTransaction        stompErrorType = "Transaction error"
+	errMessageStore       stompErrorType = "Message store error"
+	errSelector           stompErrorType = "Selector error"
+	errAuthentication     stompErrorType = "Authentication error"
+	errAuthorization      stompErrorType = "Authorization error"
 )
 
+// Errors returned by the client, to be matched with errors.Is
+var (
+	ErrInvalidTransport = errors.New("invalid transport")
+	ErrDialFailed       = errors.New("dial failed")
+	ErrConnectFailed    = errors.New("connect failed")
+	ErrAuthentication   = errors.New("authentication failed")
+	ErrConnectionLost   = errors.New("connection lost")
+	ErrTransactionLost  = errors.New("transaction lost with the connection")
+)
+
+// errorWrap is errorMsg for an error that matches err with errors.Is
+func errorWrap(t stompErrorType, err error, msg string) error {
+	return fmt.Errorf("stomp: %s: %w: %s", t, err, msg)
+}
+
 func errorMsg(t stompErrorType, msg string) error {
 	// s := string(debug.Stack())
 	return fmt.Errorf("stomp: %s: %s", t, msg)
@@ -60,6 +60,7 @@ const (
 	HdrKeyPassCode      Header = "passcode"
 	HdrKeyReceipt       Header = "receipt"
 	HdrKeyReceiptID     Header = "receipt-id"
+	HdrKeySelector      Header = "selector"
 	HdrKeyServer        Header = "server"
 	HdrKeySession       Header = "session"
 	HdrKeySubscription  Header = "subscription"
@@ -67,6 +68,17 @@ const (
 	HdrKeyVersion       Header = "version"
 )
 
+// Broker-specific headers added to the MESSAGE frames
+const (
+	HdrKeyRedeliveryCount     Header = "redelivery-count"
+	HdrKeyOriginalDestination Header = "original-destination"
+)
+
+// Broker-specific headers accepted in the SUBSCRIBE frames
+const (
+	HdrKeyPrefetchSize Header = "activemq.prefetchSize"
+)
+
 type AckMode string
 
 // Header values for AckMode
@@ -124,6 +136,7 @@ var validationMap = map[Command]typeHeaders{
 		),
 		optional: set.NewSet(
 			HdrKeyTransaction,
+			HdrKeyReceipt,
 		),
 	},
 
@@ -134,6 +147,9 @@ var validationMap = map[Command]typeHeaders{
 		),
 		optional: set.NewSet(
 			HdrKeyAck,
+			HdrKeyReceipt,
+			HdrKeySelector,
+			HdrKeyPrefetchSize,
 		),
 	},
 
@@ -141,7 +157,9 @@ var validationMap = map[Command]typeHeaders{
 		required: set.NewSet(
 			HdrKeyID,
 		),
-		optional: set.NewSet(),
+		optional: set.NewSet(
+			HdrKeyReceipt,
+		),
 	},
 
 	CmdAck: {
@@ -150,6 +168,7 @@ var validationMap = map[Command]typeHeaders{
 		),
 		optional: set.NewSet(
 			HdrKeyTransaction,
+			HdrKeyReceipt,
 		),
 	},
 
@@ -159,6 +178,7 @@ var validationMap = map[Command]typeHeaders{
 		),
 		optional: set.NewSet(
 			HdrKeyTransaction,
+			HdrKeyReceipt,
 		),
 	},
 
@@ -166,21 +186,27 @@ var validationMap = map[Command]typeHeaders{
 		required: set.NewSet(
 			HdrKeyTransaction,
 		),
-		optional: set.NewSet(),
+		optional: set.NewSet(
+			HdrKeyReceipt,
+		),
 	},
 
 	CmdCommit: {
 		required: set.NewSet(
 			HdrKeyTransaction,
 		),
-		optional: set.NewSet(),
+		optional: set.NewSet(
+			HdrKeyReceipt,
+		),
 	},
 
 	CmdAbort: {
 		required: set.NewSet(
 			HdrKeyTransaction,
 		),
-		optional: set.NewSet(),
+		optional: set.NewSet(
+			HdrKeyReceipt,
+		),
 	},
 
 	CmdDisconnect: {
@@ -212,6 +238,8 @@ var validationMap = map[Command]typeHeaders{
 		required: set.NewSet(),
 		optional: set.NewSet(
 			HdrKeyMessage,
+			HdrKeyReceiptID,
+			HdrKeyVersion,
 		),
 	},
 }
@@ -363,6 +391,15 @@ func (f Frame) String() string {
 	return sb.String()
 }
 
+// clone returns a copy of the frame that can be modified without affecting the original
+func (f *Frame) clone() *Frame {
+	headers := make(map[Header]string, len(f.headers))
+	for k, v := range f.headers {
+		headers[k] = v
+	}
+	return NewFrame(f.command, headers, f.body)
+}
+
 func (f *Frame) getHeader(h Header) string {
 	if v, ok := f.headers[h]; ok {
 		return v
@@ -0,0 +1,151 @@
+package stomp
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The heartbeats of a connection are driven by the timers of the connection itself. A timer does not hold a
+// goroutine while waiting, so the idle connections cost no more than their timers.
+
+// readTracker records the time of the last read from the connection, to tell if the peer is still alive. Any
+// incoming data, heartbeat or frame, counts.
+type readTracker struct {
+	io.Reader
+	lastRead int64 // Unix time in nanoseconds, accessed atomically
+	expired  int32 // Set when the peer is declared dead, accessed atomically
+	stopped  int32 // Set once the connection is closed, accessed atomically
+	stalled  int32 // Set while the reading is paused by the receiver, accessed atomically
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newReadTracker(r io.Reader) *readTracker {
+	return &readTracker{
+		Reader:   r,
+		lastRead: time.Now().UnixNano(),
+	}
+}
+
+func (rt *readTracker) Read(p []byte) (int, error) {
+	n, err := rt.Reader.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&rt.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watch calls onDead once nothing is read for the timeout, unless the tracker is stopped before that
+func (rt *readTracker) watch(timeout time.Duration, onDead func()) {
+	var check func()
+	check = func() {
+		if atomic.LoadInt32(&rt.stopped) == 1 {
+			return
+		}
+		idle := sinceUnixNano(&rt.lastRead)
+		if atomic.LoadInt32(&rt.stalled) == 1 {
+			idle = 0
+		}
+		if idle >= timeout {
+			atomic.StoreInt32(&rt.expired, 1)
+			onDead()
+			return
+		}
+		rt.mu.Lock()
+		rt.timer.Reset(timeout - idle)
+		rt.mu.Unlock()
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.timer = time.AfterFunc(timeout, check)
+}
+
+// stall pauses the watch while the receiver stops reading, the silence of the peer is not its fault meanwhile
+func (rt *readTracker) stall() {
+	atomic.StoreInt32(&rt.stalled, 1)
+}
+
+// resume restarts the watch once the receiver reads again
+func (rt *readTracker) resume() {
+	atomic.StoreInt64(&rt.lastRead, time.Now().UnixNano())
+	atomic.StoreInt32(&rt.stalled, 0)
+}
+
+// isExpired tells if the peer was declared dead
+func (rt *readTracker) isExpired() bool {
+	return atomic.LoadInt32(&rt.expired) == 1
+}
+
+// stop ends the watch, once the connection is closed
+func (rt *readTracker) stop() {
+	atomic.StoreInt32(&rt.stopped, 1)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.timer != nil {
+		rt.timer.Stop()
+	}
+}
+
+// heartbeater sends the heartbeats over the connection by the interval. A heartbeat is skipped when a frame was
+// written within the interval, as any data tells the peer that the connection is alive.
+type heartbeater struct {
+	lastWrite int64 // Unix time in nanoseconds, accessed atomically
+	stopped   int32 // Set once the connection is closed, accessed atomically
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newHeartbeater() *heartbeater {
+	return &heartbeater{lastWrite: time.Now().UnixNano()}
+}
+
+// wrote records the writing of a frame
+func (hb *heartbeater) wrote() {
+	atomic.StoreInt64(&hb.lastWrite, time.Now().UnixNano())
+}
+
+// start calls send by the interval, when nothing else was written for that long, until send fails or the heartbeater
+// is stopped
+func (hb *heartbeater) start(interval time.Duration, send func() error) {
+	var beat func()
+	beat = func() {
+		if atomic.LoadInt32(&hb.stopped) == 1 {
+			return
+		}
+		next := interval - sinceUnixNano(&hb.lastWrite)
+		if next <= 0 {
+			if err := send(); err != nil {
+				return
+			}
+			hb.wrote()
+			next = interval
+		}
+		hb.mu.Lock()
+		hb.timer.Reset(next)
+		hb.mu.Unlock()
+	}
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.timer = time.AfterFunc(interval, beat)
+}
+
+// stop ends sending the heartbeats, once the connection is closed
+func (hb *heartbeater) stop() {
+	atomic.StoreInt32(&hb.stopped, 1)
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	if hb.timer != nil {
+		hb.timer.Stop()
+	}
+}
+
+// sinceUnixNano returns the time elapsed since the time stored in t as Unix nanoseconds
+func sinceUnixNano(t *int64) time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(t)))
+}
@@ -0,0 +1,212 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBrokerHeartbeatLiveness(t *testing.T) {
+	broker, err := StartBroker(&BrokerOpts{
+		Port:                         "61615",
+		HeartbeatReceiveIntervalMsec: 10,
+		HeartbeatGraceMsec:           20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.ListenAndServe()
+	defer broker.Shutdown()
+	reg := broker.(*tcpBroker).reg
+
+	conn, err := net.Dial("tcp", "localhost:61615")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	frames := frameScanner(conn)
+
+	// The client promises heartbeats every 10ms, and goes silent after subscribing
+	for _, f := range []*Frame{
+		NewFrame(CmdConnect, map[Header]string{
+			HdrKeyHost:          "localhost",
+			HdrKeyAcceptVersion: supportedVersion,
+			HdrKeyHeartBeat:     "10,0",
+		}, nil),
+		NewFrame(CmdSubscribe, map[Header]string{HdrKeyID: "silent", HdrKeyDestination: "/topic/silent"}, nil),
+		NewFrame(CmdBegin, map[Header]string{HdrKeyTransaction: "silent-tx"}, nil),
+	} {
+		if _, err = conn.Write(f.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connected := readTestFrame(t, frames)
+	if connected.command != CmdConnected {
+		t.Fatal(connected)
+	}
+
+	select {
+	case _, ok := <-frames:
+		if ok {
+			t.Error("expected the connection to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the session to be closed")
+	}
+
+	// The cleanup follows the closing of the connection
+	time.Sleep(50 * time.Millisecond)
+	reg.Lock()
+	defer reg.Unlock()
+	if _, ok := reg.subsToDestMap[subsKey{sessionID: connected.getHeader(HdrKeySession), subsID: "silent"}]; ok {
+		t.Error("subscription not cleaned up")
+	}
+	if _, ok := reg.txBuffer[txKey{sessionID: connected.getHeader(HdrKeySession), txID: "silent-tx"}]; ok {
+		t.Error("transaction not cleaned up")
+	}
+}
+
+func TestClientHeartbeatLiveness(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// The broker promises heartbeats every 10ms, and goes silent after CONNECTED
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		frames := frameScanner(conn)
+		<-frames
+		_, _ = conn.Write(NewFrame(CmdConnected, map[Header]string{
+			HdrKeyVersion:   supportedVersion,
+			HdrKeySession:   "silent",
+			HdrKeyHeartBeat: "10,0",
+		}, nil).Serialize())
+		for range frames {
+		}
+	}()
+
+	closed := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err = Dial(ctx, TransportTCP, l.Addr().String(), &ClientOpts{
+		HeartbeatReceiveInterval: 10,
+		HeartbeatGrace:           20,
+		OnStateChange: func(state ConnectionState, err error) {
+			if state == StateClosed {
+				closed <- err
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-closed:
+		if !errors.Is(err, ErrConnectionLost) || !strings.Contains(err.Error(), "No heartbeat") {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the disconnect event")
+	}
+}
+
+func TestReadTrackerStall(t *testing.T) {
+	dead := make(chan struct{}, 1)
+	rt := newReadTracker(strings.NewReader(""))
+	defer rt.stop()
+	rt.watch(20*time.Millisecond, func() { dead <- struct{}{} })
+
+	// The peer is not declared dead while the receiver stops reading
+	rt.stall()
+	select {
+	case <-dead:
+		t.Fatal("peer declared dead while stalled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	rt.resume()
+	select {
+	case <-dead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not declared dead after resuming")
+	}
+}
+
+func TestHeartbeater(t *testing.T) {
+	var beats int32
+	hb := newHeartbeater()
+	hb.start(50*time.Millisecond, func() error {
+		atomic.AddInt32(&beats, 1)
+		return nil
+	})
+
+	// Frames written within the interval keep the heartbeats off
+	for i := 0; i < 10; i++ {
+		hb.wrote()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&beats); n != 0 {
+		t.Errorf("heartbeats sent while writing frames: %d", n)
+	}
+
+	time.Sleep(175 * time.Millisecond)
+	if n := atomic.LoadInt32(&beats); n < 2 {
+		t.Errorf("heartbeats sent while idle: %d, want at least 2", n)
+	}
+
+	hb.stop()
+	n := atomic.LoadInt32(&beats)
+	time.Sleep(100 * time.Millisecond)
+	if m := atomic.LoadInt32(&beats); m != n {
+		t.Errorf("heartbeats sent after stop: %d", m-n)
+	}
+}
+
+func TestClientHeartbeatNegotiation(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	c := newClientHandler(client, TransportTCP, "localhost", DefaultPort, &ClientOpts{
+		HeartbeatSendInterval:    100,
+		HeartbeatReceiveInterval: 200,
+	})
+	c.reader = newReadTracker(client)
+	defer c.heartbeater().stop()
+
+	// Each connection negotiates from the configured intervals, whatever the previous one agreed on
+	for _, test := range []struct {
+		hbVal      string
+		send, recv int
+	}{
+		{"", 0, 0},
+		{"300,50", 100, 300},
+		{"50,0", 0, 200},
+		{"0,400", 400, 0},
+	} {
+		frame := NewFrame(CmdConnected, map[Header]string{HdrKeySession: "sess", HdrKeyHeartBeat: test.hbVal}, nil)
+		if test.hbVal == "" {
+			delete(frame.headers, HdrKeyHeartBeat)
+		}
+		if err := c.handleConnected(frame); err != nil {
+			t.Fatal(err)
+		}
+		if info := c.sessionInfo; info.HeartbeatSendInterval != test.send ||
+			info.HeartbeatReceiveInterval != test.recv {
+			t.Errorf("heart-beat %q: %+v", test.hbVal, info)
+		}
+	}
+}
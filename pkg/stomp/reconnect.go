@@ -0,0 +1,270 @@
+package stomp
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// ConnectionState represents the state of the client's connection with the broker
+type ConnectionState string
+
+// Connection states reported to the StateChangeFunc
+const (
+	StateConnected    ConnectionState = "connected"    // Reconnected, with the subscriptions and transactions renewed
+	StateReconnecting ConnectionState = "reconnecting" // Connection lost, reconnecting
+	StateClosed       ConnectionState = "closed"       // Disconnected, or connection lost for good
+)
+
+// StateChangeFunc is the function-type for the user-defined function notified of the connection state changes.
+// The err is the cause of the change: nil for StateConnected, and for StateClosed after Disconnect.
+type StateChangeFunc func(state ConnectionState, err error)
+
+// ReconnectPolicy sets how the client reconnects to the broker after the connection is lost. The attempts are spaced
+// by an exponential backoff. After reconnecting the subscriptions are renewed, and the transactions in progress begun
+// again with their messages sent anew. A transaction that acknowledged messages is lost though, as the broker
+// redelivers the messages.
+type ReconnectPolicy struct {
+	InitialInterval time.Duration // Wait after the first failed attempt. Default: 500ms
+	MaxInterval     time.Duration // Cap on the wait between the attempts. Default: 1 minute
+	MaxElapsedTime  time.Duration // Give up after trying for this long. Default: 0 (never give up)
+}
+
+func (p *ReconnectPolicy) backOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	if p.InitialInterval > 0 {
+		b.InitialInterval = p.InitialInterval
+	}
+	if p.MaxInterval > 0 {
+		b.MaxInterval = p.MaxInterval
+	}
+	b.MaxElapsedTime = p.MaxElapsedTime
+	return b
+}
+
+// setReady marks the connection as established, its loss is handled from then on. It returns the cause if the
+// connection got lost before, and whether reconnecting may recover from it: not after an ERROR of the broker.
+func (c *ClientHandler) setReady() (bool, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	lost := c.lostErr
+	c.lostErr = nil
+	if err := c.brokerErr; err != nil {
+		c.brokerErr = nil
+		return false, err
+	}
+	if lost != nil {
+		return true, lost
+	}
+	c.ready = true
+	c.readyAt = time.Now()
+	return true, nil
+}
+
+// takeBrokerErr returns and clears the ERROR the broker ended the connection with, if any
+func (c *ClientHandler) takeBrokerErr() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	err := c.brokerErr
+	c.brokerErr = nil
+	return err
+}
+
+// connGen returns the generation of the current connection
+func (c *ClientHandler) connGen() uint64 {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.gen
+}
+
+func (c *ClientHandler) notifyState(state ConnectionState, err error) {
+	if c.onStateChange != nil {
+		c.onStateChange(state, err)
+	}
+}
+
+// connectionLost handles the end of the read loop on the conn, for the cause. It reconnects if the connection was
+// established, the client is not disconnecting and the broker did not end the connection with ERROR. The loss of a
+// connection not yet established is left to setReady.
+func (c *ClientHandler) connectionLost(conn net.Conn, lost error) {
+	c.connMu.Lock()
+	if conn != c.conn || !c.ready {
+		if conn == c.conn {
+			c.lostErr = lost
+		}
+		c.connMu.Unlock()
+		return
+	}
+	c.ready = false
+	brokerErr := c.brokerErr
+	c.brokerErr = nil
+	closing := c.closing
+	c.connMu.Unlock()
+
+	if brokerErr != nil {
+		lost = brokerErr
+	}
+	c.failReceipts(lost)
+	switch {
+	case closing:
+		c.closeForGood(nil)
+	case brokerErr != nil, c.reconnect == nil:
+		c.closeForGood(lost)
+	default:
+		c.redial(lost)
+	}
+}
+
+// closeForGood drops the state bound to the connection once it is not to be recovered, for the cause. The Messages
+// channels of the subscriptions are closed.
+func (c *ClientHandler) closeForGood(cause error) {
+	c.txMu.Lock()
+	c.txMap = map[string]*Transaction{}
+	c.txMu.Unlock()
+	c.closeMessages()
+	c.notifyState(StateClosed, cause)
+}
+
+// failReceipts releases the callers waiting for the receipts that won't arrive
+func (c *ClientHandler) failReceipts(err error) {
+	c.receiptsMu.Lock()
+	defer c.receiptsMu.Unlock()
+	for _, ch := range c.receipts {
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+}
+
+// stableConnection is how long a connection lasts before its loss starts the reconnect attempts afresh. A connection
+// lost sooner carries on the backoff of the attempts that made it.
+const stableConnection = 10 * time.Second
+
+// carriedBackOff carries on the backoff over the attempts of the successive redials
+type carriedBackOff struct {
+	backoff.BackOff
+}
+
+func (carriedBackOff) Reset() {}
+
+// redial reconnects to the broker with the backoff until it succeeds, the client disconnects, the broker ends the
+// connection with ERROR or the policy gives up
+func (c *ClientHandler) redial(cause error) {
+	c.notifyState(StateReconnecting, cause)
+
+	c.connMu.Lock()
+	b, wait := c.redialBackOff, time.Duration(0)
+	if b == nil || time.Since(c.readyAt) >= stableConnection {
+		b = c.reconnect.backOff()
+		c.redialBackOff = b
+	} else {
+		// The connection was lost right after the reconnect, as if the attempt failed
+		wait = b.NextBackOff()
+	}
+	c.connMu.Unlock()
+	if wait == backoff.Stop {
+		c.closeForGood(cause)
+		return
+	}
+	time.Sleep(wait)
+
+	err := backoff.RetryNotify(func() error {
+		c.connMu.Lock()
+		closing := c.closing
+		c.connMu.Unlock()
+		if closing {
+			return backoff.Permanent(errorWrap(errNetwork, ErrConnectionLost, "Disconnected while reconnecting"))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.connectTimeout)
+		defer cancel()
+		conn, err := dialTransport(ctx, c.transport, c.brokerHost, c.brokerPort, c.tlsConfig)
+		if err != nil {
+			return err
+		}
+		c.connMu.Lock()
+		c.conn = conn
+		c.gen++
+		c.connMu.Unlock()
+
+		if _, err = c.handshake(ctx, c.useStompCmd); err != nil {
+			if brokerErr := c.takeBrokerErr(); brokerErr != nil {
+				return backoff.Permanent(brokerErr)
+			}
+			return err
+		}
+		if err = c.resubscribe(); err == nil {
+			err = c.recoverTransactions()
+		}
+		if err != nil {
+			_ = conn.Close()
+			if brokerErr := c.takeBrokerErr(); brokerErr != nil {
+				return backoff.Permanent(brokerErr)
+			}
+			return err
+		}
+		if recoverable, err := c.setReady(); err != nil {
+			if !recoverable {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		return nil
+	}, carriedBackOff{b}, func(err error, wait time.Duration) {
+		log.Println("Reconnect failed, retrying in", wait, ":", err)
+	})
+	if err != nil {
+		c.closeForGood(err)
+		return
+	}
+
+	c.notifyState(StateConnected, nil)
+}
+
+// resubscribe renews the subscriptions on the new connection
+func (c *ClientHandler) resubscribe() error {
+	c.subsMu.Lock()
+	subs := make([]*Subscription, 0, len(c.subsMap))
+	for _, s := range c.subsMap {
+		subs = append(subs, s)
+	}
+	c.subsMu.Unlock()
+
+	for _, s := range subs {
+		if err := c.send(CmdSubscribe, s.headers(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverTransactions begins the transactions in progress again on the new connection, and sends their messages anew.
+// The transactions holding the acknowledgements are dropped, the messages they acknowledged are redelivered.
+func (c *ClientHandler) recoverTransactions() error {
+	gen := c.connGen()
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+	for txID, t := range c.txMap {
+		if t.gen == gen {
+			continue
+		}
+		if t.acked {
+			delete(c.txMap, txID)
+			continue
+		}
+		if err := c.send(CmdBegin, map[Header]string{HdrKeyTransaction: txID}, nil); err != nil {
+			return err
+		}
+		for _, f := range t.frames {
+			if err := c.send(f.command, f.headers, f.body); err != nil {
+				return err
+			}
+		}
+		t.gen = gen
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package stomp
+
+import (
+	"sync"
+
+	set "github.com/deckarep/golang-set"
+)
+
+// registry holds the state of a broker: the subscriptions, the messages held for the subscribers to arrive and the
+// transactions. Each broker owns one, so the brokers running in the same process do not share any state.
+//
+// The lock protects the maps. It is acquired before the lock of any subsInfo, never after. Messages are written to
+// the sessions without holding it.
+type registry struct {
+	sync.Mutex
+
+	opts *BrokerOpts
+
+	// destToSubsMap: Destination => map{ (SessionID, SubscriptionID) => SessionInfo }
+	destToSubsMap map[string]subsToInfo
+
+	// sessToDestSubs: SessionID => []SubscriberID
+	sessToSubsMap map[string]set.Set
+
+	// subsToDestMap: (SessionID, SubscriptionID) => Destination
+	subsToDestMap map[subsKey]string
+
+	// wildcardSubs indexes the wildcard destinations present in destToSubsMap
+	wildcardSubs *destTrie
+
+	// heldFrames: Destination => []Frame, messages waiting for a subscriber to arrive
+	heldFrames map[string][]*Frame
+
+	// heldBytes: Destination => total size of the bodies in heldFrames
+	heldBytes map[string]int
+
+	// queueCursor: Destination => position of the next subscriber in the queue dispatch order
+	queueCursor map[string]int
+
+	// txBuffer stores the queued-up frames for the transactions
+	// It is the mapping from the (SessionID, TransactionID) to the transaction
+	txBuffer map[txKey]*transaction
+}
+
+// newRegistry creates the empty state for the broker with the given options
+func newRegistry(opts *BrokerOpts) *registry {
+	return &registry{
+		opts:          opts,
+		destToSubsMap: map[string]subsToInfo{},
+		sessToSubsMap: map[string]set.Set{},
+		subsToDestMap: map[subsKey]string{},
+		wildcardSubs:  newDestTrie(),
+		heldFrames:    map[string][]*Frame{},
+		heldBytes:     map[string]int{},
+		queueCursor:   map[string]int{},
+		txBuffer:      map[txKey]*transaction{},
+	}
+}
@@ -0,0 +1,546 @@
+package stomp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The selector is an SQL-92-like boolean expression over the message headers, set on SUBSCRIBE to filter the
+// messages delivered to the subscription, e.g. `priority > 5 AND region = 'eu'`. The supported syntax:
+//
+//	Literals:    'string' (quote escaped as ''), numbers, TRUE, FALSE, NULL
+//	Identifiers: header names, evaluated to the header value or NULL if the header is absent
+//	Comparison:  =, <>, !=, <, <=, >, >=
+//	Predicates:  [NOT] BETWEEN a AND b, [NOT] IN ('a', 'b'), [NOT] LIKE 'pattern' (% and _), IS [NOT] NULL
+//	Logical:     NOT, AND, OR, parentheses
+//
+// A header value is compared as a number when the other operand is a number. The comparisons involving NULL are
+// unknown, following the three-valued logic of SQL, and a message is delivered only if the selector is TRUE.
+
+// selector is the parsed expression
+type selector interface {
+	// eval returns the value of the expression for the message headers: nil (NULL/unknown), bool, float64 or string
+	eval(headers map[Header]string) interface{}
+}
+
+// parseSelector parses the selector expression
+func parseSelector(expr string) (selector, error) {
+	tokens, err := lexSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens}
+	sel, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, errorMsg(errSelector, "Unexpected '"+tok.text+"' in: "+expr)
+	}
+	return sel, nil
+}
+
+// selects tells if the message headers satisfy the selector
+func selects(sel selector, headers map[Header]string) bool {
+	return sel == nil || sel.eval(headers) == true
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokKeyword
+	tokString
+	tokNumber
+	tokOperator
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string // Keywords are upper-cased, strings are unquoted
+}
+
+var selectorKeywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true, "BETWEEN": true, "IN": true, "LIKE": true, "IS": true,
+	"NULL": true, "TRUE": true, "FALSE": true,
+}
+
+// lexSelector splits the selector expression into tokens
+func lexSelector(expr string) ([]token, error) {
+	var tokens []token
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")"})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ","})
+			i++
+
+		case r == '=':
+			tokens = append(tokens, token{tokOperator, "="})
+			i++
+		case r == '<' || r == '>' || r == '!':
+			op := string(r)
+			if i+1 < len(rs) && (rs[i+1] == '=' || (r == '<' && rs[i+1] == '>')) {
+				op += string(rs[i+1])
+			}
+			if op == "!" {
+				return nil, errorMsg(errSelector, "Unexpected '!' in: "+expr)
+			}
+			tokens = append(tokens, token{tokOperator, op})
+			i += len(op)
+
+		case r == '\'':
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(rs) {
+					return nil, errorMsg(errSelector, "Unterminated string in: "+expr)
+				}
+				if rs[i] == '\'' {
+					if i+1 < len(rs) && rs[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+				sb.WriteRune(rs[i])
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+			i++
+
+		case unicode.IsDigit(r) || ((r == '-' || r == '+' || r == '.') && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E' ||
+				((rs[j] == '-' || rs[j] == '+') && (rs[j-1] == 'e' || rs[j-1] == 'E'))) {
+				j++
+			}
+			num := string(rs[i:j])
+			if _, err := strconv.ParseFloat(num, 64); err != nil {
+				return nil, errorMsg(errSelector, "Invalid number '"+num+"' in: "+expr)
+			}
+			tokens = append(tokens, token{tokNumber, num})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || strings.ContainsRune("_$-.", rs[j])) {
+				j++
+			}
+			word := string(rs[i:j])
+			if upper := strings.ToUpper(word); selectorKeywords[upper] {
+				tokens = append(tokens, token{tokKeyword, upper})
+			} else {
+				tokens = append(tokens, token{tokIdent, word})
+			}
+			i = j
+
+		default:
+			return nil, errorMsg(errSelector, "Unexpected '"+string(r)+"' in: "+expr)
+		}
+	}
+	return append(tokens, token{tokEOF, "end of selector"}), nil
+}
+
+// selectorParser is the recursive-descent parser, from the lowest precedence (OR) to the operands
+type selectorParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *selectorParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *selectorParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the given keyword
+func (p *selectorParser) accept(keyword string) bool {
+	if tok := p.peek(); tok.kind == tokKeyword && tok.text == keyword {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, errorMsg(errSelector, "Expected "+what+", found '"+tok.text+"'")
+	}
+	return tok, nil
+}
+
+func (p *selectorParser) parseOr() (selector, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orSelector{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseAnd() (selector, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andSelector{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseNot() (selector, error) {
+	if p.accept("NOT") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notSelector{operand}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *selectorParser) parsePredicate() (selector, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind == tokOperator {
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &compareSelector{tok.text, left, right}, nil
+	}
+
+	if p.accept("IS") {
+		not := p.accept("NOT")
+		if !p.accept("NULL") {
+			return nil, errorMsg(errSelector, "Expected NULL after IS, found '"+p.peek().text+"'")
+		}
+		return negate(&isNullSelector{left}, not), nil
+	}
+
+	not := p.accept("NOT")
+	switch {
+	case p.accept("BETWEEN"):
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("AND") {
+			return nil, errorMsg(errSelector, "Expected AND in BETWEEN, found '"+p.peek().text+"'")
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return negate(&andSelector{&compareSelector{">=", left, low}, &compareSelector{"<=", left, high}}, not), nil
+
+	case p.accept("IN"):
+		if _, err = p.expect(tokLParen, "'(' after IN"); err != nil {
+			return nil, err
+		}
+		in := &inSelector{operand: left}
+		for {
+			tok, err := p.expect(tokString, "string in the IN list")
+			if err != nil {
+				return nil, err
+			}
+			in.values = append(in.values, tok.text)
+			if tok = p.next(); tok.kind == tokRParen {
+				break
+			} else if tok.kind != tokComma {
+				return nil, errorMsg(errSelector, "Expected ',' or ')' in the IN list, found '"+tok.text+"'")
+			}
+		}
+		return negate(in, not), nil
+
+	case p.accept("LIKE"):
+		tok, err := p.expect(tokString, "pattern after LIKE")
+		if err != nil {
+			return nil, err
+		}
+		return negate(&likeSelector{left, likePattern(tok.text)}, not), nil
+	}
+
+	if not {
+		return nil, errorMsg(errSelector, "Expected BETWEEN, IN or LIKE after NOT, found '"+p.peek().text+"'")
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseOperand() (selector, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokIdent:
+		return identSelector(tok.text), nil
+	case tokString:
+		return &literalSelector{tok.text}, nil
+	case tokNumber:
+		n, _ := strconv.ParseFloat(tok.text, 64)
+		return &literalSelector{n}, nil
+	case tokKeyword:
+		switch tok.text {
+		case "TRUE":
+			return &literalSelector{true}, nil
+		case "FALSE":
+			return &literalSelector{false}, nil
+		case "NULL":
+			return &literalSelector{nil}, nil
+		}
+	case tokLParen:
+		sel, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return sel, nil
+	}
+	return nil, errorMsg(errSelector, "Unexpected '"+tok.text+"'")
+}
+
+func negate(sel selector, not bool) selector {
+	if not {
+		return &notSelector{sel}
+	}
+	return sel
+}
+
+// likePattern translates the LIKE pattern into the anchored regular expression
+func likePattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+type identSelector string
+
+func (s identSelector) eval(headers map[Header]string) interface{} {
+	if v, ok := headers[Header(s)]; ok {
+		return v
+	}
+	// The client library sends the custom headers in lower-case
+	if v, ok := headers[Header(strings.ToLower(string(s)))]; ok {
+		return v
+	}
+	return nil
+}
+
+type literalSelector struct {
+	value interface{}
+}
+
+func (s *literalSelector) eval(map[Header]string) interface{} {
+	return s.value
+}
+
+type notSelector struct {
+	operand selector
+}
+
+func (s *notSelector) eval(headers map[Header]string) interface{} {
+	if v, ok := s.operand.eval(headers).(bool); ok {
+		return !v
+	}
+	return nil
+}
+
+type andSelector struct {
+	left, right selector
+}
+
+func (s *andSelector) eval(headers map[Header]string) interface{} {
+	l, r := s.left.eval(headers), s.right.eval(headers)
+	if l == false || r == false {
+		return false
+	}
+	if l == true && r == true {
+		return true
+	}
+	return nil
+}
+
+type orSelector struct {
+	left, right selector
+}
+
+func (s *orSelector) eval(headers map[Header]string) interface{} {
+	l, r := s.left.eval(headers), s.right.eval(headers)
+	if l == true || r == true {
+		return true
+	}
+	if l == false && r == false {
+		return false
+	}
+	return nil
+}
+
+type compareSelector struct {
+	op          string
+	left, right selector
+}
+
+func (s *compareSelector) eval(headers map[Header]string) interface{} {
+	l, r := s.left.eval(headers), s.right.eval(headers)
+	if l == nil || r == nil {
+		return nil
+	}
+
+	// The header values are strings, convert them to the type of the other operand
+	l, r = coerce(l, r), coerce(r, l)
+	var cmp int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return nil
+		}
+		cmp = compareOrdered(lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return nil
+		}
+		cmp = strings.Compare(lv, rv)
+	case bool:
+		rv, ok := r.(bool)
+		if !ok || (s.op != "=" && s.op != "<>" && s.op != "!=") {
+			return nil
+		}
+		if lv != rv {
+			cmp = 1
+		}
+	}
+
+	switch s.op {
+	case "=":
+		return cmp == 0
+	case "<>", "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return nil
+}
+
+// coerce converts the string value to the type of the other operand, leaving it as-is if it doesn't convert
+func coerce(v, other interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch other.(type) {
+	case float64:
+		if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return n
+		}
+	case bool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return v
+}
+
+func compareOrdered(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+type isNullSelector struct {
+	operand selector
+}
+
+func (s *isNullSelector) eval(headers map[Header]string) interface{} {
+	return s.operand.eval(headers) == nil
+}
+
+type inSelector struct {
+	operand selector
+	values  []string
+}
+
+func (s *inSelector) eval(headers map[Header]string) interface{} {
+	v, ok := s.operand.eval(headers).(string)
+	if !ok {
+		return nil
+	}
+	for _, value := range s.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type likeSelector struct {
+	operand selector
+	pattern *regexp.Regexp
+}
+
+func (s *likeSelector) eval(headers map[Header]string) interface{} {
+	v, ok := s.operand.eval(headers).(string)
+	if !ok {
+		return nil
+	}
+	return s.pattern.MatchString(v)
+}
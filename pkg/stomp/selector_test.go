@@ -0,0 +1,51 @@
+package stomp
+
+import "testing"
+
+func TestSelector(t *testing.T) {
+	headers := map[Header]string{
+		"priority": "7",
+		"region":   "eu",
+		"urgent":   "true",
+		"name":     "order-42",
+	}
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"priority > 5 AND region = 'eu'", true},
+		{"priority > 5 AND region = 'us'", false},
+		{"priority < 5 OR region <> 'us'", true},
+		{"NOT (priority >= 7)", false},
+		{"priority BETWEEN 5 AND 10", true},
+		{"priority NOT BETWEEN 5 AND 10", false},
+		{"region IN ('eu', 'us')", true},
+		{"region NOT IN ('eu', 'us')", false},
+		{"name LIKE 'order-%'", true},
+		{"name LIKE 'order_'", false},
+		{"urgent = TRUE", true},
+		{"missing IS NULL", true},
+		{"missing IS NOT NULL", false},
+		{"missing = 'x'", false},
+		{"NOT missing = 'x'", false},
+		{"missing = 'x' OR region = 'eu'", true},
+		{"region = 'it''s'", false},
+		{"Priority > 5", true},
+	}
+	for _, tc := range tests {
+		sel, err := parseSelector(tc.expr)
+		if err != nil {
+			t.Error(tc.expr, err)
+			continue
+		}
+		if got := selects(sel, headers); got != tc.match {
+			t.Error(tc.expr, got)
+		}
+	}
+
+	for _, expr := range []string{"priority >", "region = 'eu", "(priority > 5", "region IN 'eu'", "a ! b", "a NOT 5"} {
+		if _, err := parseSelector(expr); err == nil {
+			t.Error("expected error:", expr)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// MessageStore persists the messages sent to the queue destinations, so they survive a restart of the broker.
+// The messages are identified by their `message-id` header.
+type MessageStore interface {
+	// Append persists the SEND frame
+	Append(frame *Frame) error
+
+	// AppendBatch persists the SEND frames of a committed transaction atomically: after a crash either all of them
+	// are present in the store or none is
+	AppendBatch(frames []*Frame) error
+
+	// Delete removes the message once it is acknowledged by the subscriber
+	Delete(messageID string) error
+
+	// Replay calls fn on every message that is still present in the store, in the order they were appended
+	Replay(fn func(frame *Frame) error) error
+}
+
+// Record types in the write-ahead log
+const (
+	walAppend byte = 'A'
+	walDelete byte = 'D'
+	walBatch  byte = 'B' // Append records of a batch, nested in the payload
+)
+
+// compactThreshold is the count of deleted messages that triggers the compaction of the log, once they also
+// outnumber the live messages
+const compactThreshold = 1024
+
+// FileStore is the MessageStore backed by an append-only file (write-ahead log). Each record holds either the
+// appended frame or the ID of the deleted message. The log is compacted to the live messages when it is opened, and
+// whenever the deleted messages pile up (see compactThreshold).
+type FileStore struct {
+	sync.Mutex
+
+	path         string
+	file         *os.File
+	live         int // Messages appended and not deleted yet
+	deleted      int // Messages deleted since the last compaction
+	compactAfter int // Deleted messages that trigger the compaction
+}
+
+// NewFileStore opens the write-ahead log at path, creating it if needed
+func NewFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{path: path, compactAfter: compactThreshold}
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// open opens the log for appending
+func (fs *FileStore) open() error {
+	var err error
+	if fs.file, err = os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+		return errorMsg(errMessageStore, "Open failed: "+err.Error())
+	}
+	return nil
+}
+
+// Append writes the frame to the log and syncs it to the disk
+func (fs *FileStore) Append(frame *Frame) error {
+	if frame.getHeader(HdrKeyMessageID) == "" {
+		return errorMsg(errMessageStore, "Missing message-id in the frame to store")
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	if err := writeRecord(fs.file, walAppend, frame.Serialize()); err != nil {
+		return errorMsg(errMessageStore, "Append failed: "+err.Error())
+	}
+	if err := fs.file.Sync(); err != nil {
+		return errorMsg(errMessageStore, "Sync failed: "+err.Error())
+	}
+	fs.live++
+	return nil
+}
+
+// AppendBatch writes the frames to the log as a single record and syncs it to the disk. A crash in the middle of the
+// write leaves the record truncated, and a truncated record is ignored as a whole.
+func (fs *FileStore) AppendBatch(frames []*Frame) error {
+	var batch bytes.Buffer
+	for _, frame := range frames {
+		if frame.getHeader(HdrKeyMessageID) == "" {
+			return errorMsg(errMessageStore, "Missing message-id in the frame to store")
+		}
+		if err := writeRecord(&batch, walAppend, frame.Serialize()); err != nil {
+			return errorMsg(errMessageStore, "Append failed: "+err.Error())
+		}
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	if err := writeRecord(fs.file, walBatch, batch.Bytes()); err != nil {
+		return errorMsg(errMessageStore, "Append failed: "+err.Error())
+	}
+	if err := fs.file.Sync(); err != nil {
+		return errorMsg(errMessageStore, "Sync failed: "+err.Error())
+	}
+	fs.live += len(frames)
+	return nil
+}
+
+// Delete writes the deletion record for the message to the log, and compacts the log once the deleted messages pile
+// up. A failed compaction is retried on the next deletion.
+func (fs *FileStore) Delete(messageID string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if err := writeRecord(fs.file, walDelete, []byte(messageID)); err != nil {
+		return errorMsg(errMessageStore, "Delete failed: "+err.Error())
+	}
+	if fs.live > 0 {
+		fs.live--
+	}
+	fs.deleted++
+	if fs.deleted < fs.compactAfter || fs.deleted <= fs.live {
+		return nil
+	}
+	_ = fs.file.Close()
+	if err := fs.compact(); err != nil {
+		log.Println(err)
+	}
+	return fs.open()
+}
+
+// Replay reads the log and calls fn on every message not deleted yet
+func (fs *FileStore) Replay(fn func(frame *Frame) error) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	frames, err := readLog(fs.path)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err = fn(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying log file
+func (fs *FileStore) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.file.Close()
+}
+
+// compact rewrites the log with only the live messages
+func (fs *FileStore) compact() error {
+	frames, err := readLog(fs.path)
+	if err != nil {
+		return err
+	}
+
+	tmp := fs.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errorMsg(errMessageStore, "Compaction failed: "+err.Error())
+	}
+	w := bufio.NewWriter(f)
+	for _, frame := range frames {
+		if err = writeRecord(w, walAppend, frame.Serialize()); err != nil {
+			_ = f.Close()
+			return errorMsg(errMessageStore, "Compaction failed: "+err.Error())
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fs.path)
+	}
+	if err != nil {
+		return errorMsg(errMessageStore, "Compaction failed: "+err.Error())
+	}
+	fs.live, fs.deleted = len(frames), 0
+	return nil
+}
+
+// writeRecord writes the record as: type (1 byte), payload length (4 bytes, big-endian), payload
+func writeRecord(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// readLog returns the frames from the log that were appended and not deleted, in the order of appending.
+// A truncated record at the end of the log, left by a crash in the middle of a write, is ignored.
+func readLog(path string) ([]*Frame, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorMsg(errMessageStore, "Read failed: "+err.Error())
+	}
+	defer func() { _ = f.Close() }()
+
+	var order []string
+	live := map[string]*Frame{}
+	var apply func(typ byte, payload []byte) error
+	apply = func(typ byte, payload []byte) error {
+		switch typ {
+		case walAppend:
+			frame, err := NewFrameFromBytes(payload)
+			if err != nil {
+				return errorMsg(errMessageStore, "Corrupt record: "+err.Error())
+			}
+			id := frame.getHeader(HdrKeyMessageID)
+			order = append(order, id)
+			live[id] = frame
+		case walDelete:
+			delete(live, string(payload))
+		case walBatch:
+			return readRecords(bytes.NewReader(payload), func(typ byte, payload []byte) error {
+				if typ != walAppend {
+					return errorMsg(errMessageStore, "Corrupt batch record type: "+string(typ))
+				}
+				return apply(typ, payload)
+			})
+		default:
+			return errorMsg(errMessageStore, "Corrupt record type: "+string(typ))
+		}
+		return nil
+	}
+	if err = readRecords(bufio.NewReader(f), apply); err != nil {
+		return nil, err
+	}
+
+	frames := make([]*Frame, 0, len(live))
+	for _, id := range order {
+		if frame, ok := live[id]; ok {
+			frames = append(frames, frame)
+			delete(live, id)
+		}
+	}
+	return frames, nil
+}
+
+// readRecords calls fn on each record read from r. A truncated record at the end is ignored.
+func readRecords(r io.Reader, fn func(typ byte, payload []byte) error) error {
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return errorMsg(errMessageStore, "Read failed: "+err.Error())
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return nil
+			}
+			return errorMsg(errMessageStore, "Read failed: "+err.Error())
+		}
+		if err := fn(hdr[0], payload); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package stomp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func storeTestFrame(id, body string) *Frame {
+	return NewFrame(CmdSend, map[Header]string{
+		HdrKeyDestination: "/queue/store",
+		HdrKeyMessageID:   id,
+	}, []byte(body))
+}
+
+func replayBodies(t *testing.T, fs *FileStore) []string {
+	var bodies []string
+	if err := fs.Replay(func(frame *Frame) error {
+		bodies = append(bodies, string(frame.body))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return bodies
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err = fs.Append(storeTestFrame(id, "msg"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.Append(NewFrame(CmdSend, map[Header]string{}, nil)); err == nil {
+		t.Error("expected error for missing message-id")
+	}
+	if err = fs.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayBodies(t, fs); len(got) != 2 || got[0] != "msg1" || got[1] != "msg3" {
+		t.Error(got)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte{walAppend, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	// Reopening compacts the log and keeps the live messages
+	if fs, err = NewFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	if got := replayBodies(t, fs); len(got) != 2 || got[0] != "msg1" || got[1] != "msg3" {
+		t.Error(got)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	fs.compactAfter = 2
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err = fs.Append(storeTestFrame(id, "msg"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	full := size()
+
+	// The log is compacted once the deleted messages outnumber the live ones
+	if err = fs.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if size() <= full {
+		t.Error("compacted before the threshold")
+	}
+	if err = fs.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	if size() >= full {
+		t.Error("not compacted after the threshold")
+	}
+	if err = fs.Append(storeTestFrame("4", "msg4")); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayBodies(t, fs); len(got) != 2 || got[0] != "msg3" || got[1] != "msg4" {
+		t.Error(got)
+	}
+}
+
+func TestPublishWithMessageStore(t *testing.T) {
+	fs, err := NewFileStore(filepath.Join(t.TempDir(), "store.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+
+	reg := newTestRegistry()
+	reg.opts.MessageStore = fs
+	dest := "/queue/stored"
+	sess, ch := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+	if err = reg.addSubscription(dest, "stored-a", HdrValAckClientIndividual, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	if err = reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte("keep")), ""); err != nil {
+		t.Fatal(err)
+	}
+	msg := recvFrame(t, ch)
+	if got := replayBodies(t, fs); len(got) != 1 || got[0] != "keep" {
+		t.Error(got)
+	}
+
+	// Acknowledged messages are deleted from the store
+	if err = reg.processAck(sess.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayBodies(t, fs); len(got) != 0 {
+		t.Error(got)
+	}
+}
+
+func TestFileStoreBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.AppendBatch([]*Frame{storeTestFrame("1", "msg1"), storeTestFrame("2", "msg2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.AppendBatch([]*Frame{storeTestFrame("3", "msg3"), NewFrame(CmdSend, nil, nil)}); err == nil {
+		t.Error("expected error for missing message-id")
+	}
+	if err = fs.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing a batch: none of its messages survive
+	var batch bytes.Buffer
+	for _, id := range []string{"4", "5"} {
+		if err = writeRecord(&batch, walAppend, storeTestFrame(id, "msg"+id).Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var record bytes.Buffer
+	if err = writeRecord(&record, walBatch, batch.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(record.Bytes()[:record.Len()-3]); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if fs, err = NewFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	if got := replayBodies(t, fs); len(got) != 1 || got[0] != "msg2" {
+		t.Error(got)
+	}
+}
+
+// failingStore fails to persist the batches
+type failingStore struct {
+	MessageStore
+}
+
+func (failingStore) AppendBatch([]*Frame) error {
+	return errorMsg(errMessageStore, "Disk full")
+}
+
+func TestCommitWithMessageStore(t *testing.T) {
+	fs, err := NewFileStore(filepath.Join(t.TempDir(), "store.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+
+	reg := newTestRegistry()
+	sess, ch := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+	for _, dest := range []string{"/queue/commit-a", "/queue/commit-b"} {
+		if err = reg.addSubscription(dest, dest, HdrValAckAuto, "", 0, sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(txID string) error {
+		if err := reg.startTx(sess.sessionID, txID); err != nil {
+			t.Fatal(err)
+		}
+		for _, dest := range []string{"/queue/commit-a", "/queue/commit-b"} {
+			f := NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(txID))
+			if err := reg.bufferTxFrame(sess.sessionID, txID, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return reg.commitTx(sess.sessionID, txID)
+	}
+
+	// Nothing is delivered when the batch is not persisted
+	reg.opts.MessageStore = failingStore{fs}
+	if err = commit("tx-fail"); err == nil {
+		t.Error("expected error committing to the failing store")
+	}
+	select {
+	case f := <-ch:
+		t.Error("unexpected delivery:", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reg.opts.MessageStore = fs
+	if err = commit("tx-ok"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if f := recvFrame(t, ch); string(f.body) != "tx-ok" {
+			t.Error(f)
+		}
+	}
+	if _, ok := reg.txBuffer[txKey{sessionID: sess.sessionID, txID: "tx-ok"}]; ok {
+		t.Error("transaction kept after commit")
+	}
+}
+
+// fillingStore persists the batches, then runs fill as if other messages arrived meanwhile
+type fillingStore struct {
+	MessageStore
+	fill func()
+}
+
+func (s fillingStore) AppendBatch(frames []*Frame) error {
+	if err := s.MessageStore.AppendBatch(frames); err != nil {
+		return err
+	}
+	s.fill()
+	return nil
+}
+
+func TestCommitFailures(t *testing.T) {
+	fs, err := NewFileStore(filepath.Join(t.TempDir(), "store.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+
+	reg := newTestRegistry()
+	reg.opts.MessageStore = fs
+	reg.opts.OverflowPolicy = OverflowReject
+	reg.opts.MaxHeldMessages = 1
+	sess, ch := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+	send := func(dest, body string) *Frame {
+		return NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(body))
+	}
+	commit := func(txID string, frames ...*Frame) error {
+		if err := reg.startTx(sess.sessionID, txID); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range frames {
+			if err := reg.bufferTxFrame(sess.sessionID, txID, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return reg.commitTx(sess.sessionID, txID)
+	}
+
+	if err = reg.addSubscription("/queue/commit-ack", "commit-ack", HdrValAckClientIndividual, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	if err = reg.publish(send("/queue/commit-ack", "acked"), ""); err != nil {
+		t.Fatal(err)
+	}
+	ack := NewFrame(CmdAck, map[Header]string{HdrKeyID: recvFrame(t, ch).getHeader(HdrKeyAck)}, nil)
+	if err = reg.publish(send("/queue/commit-full", "held"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is persisted nor delivered when a destination has no room
+	if err = commit("tx-full", send("/queue/commit-ack", "early"), send("/queue/commit-full", "rejected")); err == nil {
+		t.Error("expected error committing to the full destination")
+	}
+	select {
+	case f := <-ch:
+		t.Error("unexpected delivery:", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := replayBodies(t, fs); len(got) != 2 || got[0] != "acked" || got[1] != "held" {
+		t.Error(got)
+	}
+
+	// The destination filling up once the batch is persisted fails its message alone
+	reg.opts.MessageStore = fillingStore{fs, func() {
+		reg.Lock()
+		reg.holdFrame("/queue/commit-late", send("/queue/commit-late", "filler"))
+		reg.Unlock()
+	}}
+	if err = commit("tx-late", send("/queue/commit-late", "late"), send("/queue/commit-ack", "ok"), ack); err == nil {
+		t.Error("expected error delivering to the destination filled up")
+	}
+	if f := recvFrame(t, ch); string(f.body) != "ok" {
+		t.Error(f)
+	}
+	info, _ := reg.getSubsInfo(sess.sessionID, "commit-ack")
+	if n := info.pendingCount(); n != 1 {
+		t.Error("pending:", n)
+	}
+	if got := replayBodies(t, fs); len(got) != 2 || got[0] != "held" || got[1] != "ok" {
+		t.Error(got)
+	}
+}
@@ -1,177 +1,881 @@
 package stomp
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/RoaringBitmap/roaring"
 	set "github.com/deckarep/golang-set"
+	"github.com/google/uuid"
 )
 
 type subsInfo struct {
 	sync.Mutex
+	sendMu sync.Mutex // Keeps the MESSAGE frames in order on the outbound queue, taken before the lock
 
 	sessionHandler   *Session
 	ackMode          AckMode
 	nextAckNum       uint32
 	pendingAckBitmap roaring.Bitmap
+	pendingFrames    map[uint32]*Frame // Ack number => frame awaiting ACK/NACK, kept for the redelivery
+	selector         selector          // Filter on the message headers, nil to receive all
+	prefetch         uint64            // Cap on the messages pending acknowledgement, 0 for no cap
+	backlog          []*backlogFrame   // Topic messages waiting for the pending ones to be acknowledged
+	room             chan struct{}     // Closed when the acknowledgements make room, then replaced
+	closed           bool              // Set once the subscription is removed
+	pending          int64             // Count of the messages pending acknowledgement, accessed atomically
+	queued           int64             // Count of the messages in the backlog, accessed atomically
 }
 
-// subsToInfo: SubscriptionID => (Session, AckMode[auto/client/client-individual], etc...)
-type subsToInfo map[string]*subsInfo
+// backlogFrame is a message waiting for the room under the prefetch limit of the subscription
+type backlogFrame struct {
+	dest   string
+	subsID string
+	txID   string
+	frame  *Frame
+}
+
+// subsKey identifies the subscription: its ID is unique only within the session that made it
+type subsKey struct {
+	sessionID string
+	subsID    string
+}
 
-var (
-	// destToSubsMap: Destination => map{ SubscriptionID => SessionInfo }
-	destToSubsMap = map[string]subsToInfo{}
+// subsToInfo: (SessionID, SubscriptionID) => (Session, AckMode[auto/client/client-individual], etc...)
+type subsToInfo map[subsKey]*subsInfo
 
-	// sessToDestSubs: SessionID => []SubscriberID
-	sessToSubsMap = map[string]set.Set{}
+// errSubsClosed is returned when delivering to a subscription that got removed in the meantime
+var errSubsClosed = errors.New("subscription closed")
 
-	// subsToDestMap: SubscriptionID => Destination
-	subsToDestMap = map[string]string{}
-)
+// errSubsFull is returned when delivering a queue message to a subscription at its prefetch limit in the meantime
+var errSubsFull = errors.New("subscription full")
 
-func addSubscription(dest string, subsID string, ackMode AckMode, sess *Session) error {
+func (r *registry) addSubscription(dest string, subsID string, ackMode AckMode, selectorExpr string, prefetch int,
+	sess *Session,
+) error {
 	if subsID == "" {
 		return errorMsg(errBrokerStateMachine, "Missing ID when adding subscription")
 	}
 	if dest == "" {
 		return errorMsg(errBrokerStateMachine, "Missing destination when adding subscription, subsID: "+subsID)
 	}
-	if _, ok := destToSubsMap[dest][subsID]; !ok {
-		destToSubsMap[dest] = subsToInfo{}
+	wildcard := isWildcardDest(dest)
+	if wildcard {
+		if err := validateWildcardDest(dest); err != nil {
+			return err
+		}
 	}
-
-	destToSubsMap[dest][subsID] = &subsInfo{
+	info := &subsInfo{
 		sessionHandler: sess,
 		ackMode:        ackMode,
+		pendingFrames:  map[uint32]*Frame{},
+		room:           make(chan struct{}),
+	}
+	// Nothing is pending in the `auto` mode, the prefetch limit does not apply
+	if ackMode != HdrValAckAuto && prefetch > 0 {
+		info.prefetch = uint64(prefetch)
+	}
+	if selectorExpr != "" {
+		sel, err := parseSelector(selectorExpr)
+		if err != nil {
+			return err
+		}
+		info.selector = sel
+	}
+
+	key := subsKey{sessionID: sess.sessionID, subsID: subsID}
+	r.Lock()
+	if _, ok := r.destToSubsMap[dest]; !ok {
+		r.destToSubsMap[dest] = subsToInfo{}
+		if wildcard {
+			r.wildcardSubs.insert(dest)
+		}
 	}
+	r.destToSubsMap[dest][key] = info
 
-	subsToDestMap[subsID] = dest
+	r.subsToDestMap[key] = dest
 
-	if _, ok := sessToSubsMap[sess.sessionID]; !ok {
-		sessToSubsMap[sess.sessionID] = set.NewSet()
+	if _, ok := r.sessToSubsMap[sess.sessionID]; !ok {
+		r.sessToSubsMap[sess.sessionID] = set.NewSet()
 	}
-	sessToSubsMap[sess.sessionID].Add(subsID)
+	r.sessToSubsMap[sess.sessionID].Add(subsID)
+
+	var heldDests []string
+	for heldDest := range r.heldFrames {
+		if heldDest == dest || (wildcard && destMatches(dest, heldDest)) {
+			heldDests = append(heldDests, heldDest)
+		}
+	}
+	var held []*Frame
+	for _, heldDest := range heldDests {
+		frames := r.heldFrames[heldDest]
+		delete(r.heldFrames, heldDest)
+		delete(r.heldBytes, heldDest)
+		for _, frame := range frames {
+			// The messages not selected by the subscriber stay held for the others
+			if selects(info.selector, frame.headers) {
+				held = append(held, frame)
+			} else {
+				r.holdFrame(heldDest, frame)
+			}
+		}
+	}
+	r.Unlock()
+
+	r.releaseHeldFrames(subsID, info, held)
 	return nil
 }
 
-func removeSubscription(subsID string) error {
-	if subsID == "" {
-		return errorMsg(errBrokerStateMachine, "Missing subscription ID when removing subscription")
+// holdFrame keeps the message until a subscriber for the destination arrives. The caller must hold the lock.
+func (r *registry) holdFrame(dest string, frame *Frame) {
+	r.heldFrames[dest] = append(r.heldFrames[dest], frame)
+	r.heldBytes[dest] += len(frame.body)
+}
+
+// releaseHeldFrames delivers the messages that were held for the subscribed destination(s) to the new subscriber
+func (r *registry) releaseHeldFrames(subsID string, info *subsInfo, frames []*Frame) {
+	for i, frame := range frames {
+		if err := info.deliver(frame.getHeader(HdrKeyDestination), subsID, "", frame); err != nil {
+			if !errors.Is(err, errSubsFull) {
+				log.Println(err)
+			}
+			r.Lock()
+			for _, f := range frames[i:] {
+				r.holdFrame(f.getHeader(HdrKeyDestination), f)
+			}
+			r.Unlock()
+			return
+		}
 	}
-	if _, ok := subsToDestMap[subsID]; !ok {
-		return errorMsg(errBrokerStateMachine, "No such subscription present to unsubscribe, subsID: "+subsID)
+}
+
+// pullHeldFrames hands the messages held by the queue destinations of the subscription to it, as long as it stays
+// below its prefetch limit
+func (r *registry) pullHeldFrames(key subsKey, info *subsInfo) {
+	for !info.isFull() {
+		r.Lock()
+		dest, frame := r.takeHeldFrame(key, info)
+		r.Unlock()
+		if frame == nil {
+			return
+		}
+		if err := info.deliver(dest, key.subsID, "", frame); err != nil {
+			if !errors.Is(err, errSubsFull) && !errors.Is(err, errSubsClosed) {
+				log.Println(err)
+			}
+			r.Lock()
+			r.heldFrames[dest] = append([]*Frame{frame}, r.heldFrames[dest]...)
+			r.heldBytes[dest] += len(frame.body)
+			r.Unlock()
+			return
+		}
+	}
+}
+
+// takeHeldFrame removes the oldest message selected by the subscription from the held messages of its destination,
+// or of a destination matching its wildcard. The caller must hold the lock.
+func (r *registry) takeHeldFrame(key subsKey, info *subsInfo) (string, *Frame) {
+	subscribed, ok := r.subsToDestMap[key]
+	if !ok {
+		return "", nil
+	}
+	wildcard := isWildcardDest(subscribed)
+	for heldDest, frames := range r.heldFrames {
+		if heldDest != subscribed && !(wildcard && destMatches(subscribed, heldDest)) {
+			continue
+		}
+		for i, frame := range frames {
+			if !selects(info.selector, frame.headers) {
+				continue
+			}
+			r.heldFrames[heldDest] = append(frames[:i:i], frames[i+1:]...)
+			r.heldBytes[heldDest] -= len(frame.body)
+			if len(r.heldFrames[heldDest]) == 0 {
+				delete(r.heldFrames, heldDest)
+				delete(r.heldBytes, heldDest)
+			}
+			return heldDest, frame
+		}
 	}
-	dest := subsToDestMap[subsID]
+	return "", nil
+}
 
-	if _, ok := destToSubsMap[dest]; !ok {
-		return errorMsg(errBrokerStateMachine, "No such subscription for given destination, subsID: "+subsID)
+// bufferFrame keeps the message sent to the queue destination without subscribers, to be forwarded to the first
+// subscriber that arrives. The OverflowPolicy applies when the destination is holding MaxHeldMessages or MaxHeldBytes.
+// The caller must hold the lock.
+func (r *registry) bufferFrame(dest string, frame *Frame) error {
+	opts := r.opts
+	if opts.MaxHeldBytes != 0 && len(frame.body) > opts.MaxHeldBytes {
+		r.forgetStored(frame)
+		return errorMsg(errBrokerStateMachine, "Message larger than MaxHeldBytes, no subscribers to receive: "+dest)
 	}
-	sess := destToSubsMap[dest][subsID].sessionHandler.sessionID
 
-	sessToSubsMap[sess].Remove(subsID)
-	delete(destToSubsMap[dest], subsID)
-	if len(destToSubsMap[dest]) == 0 {
-		delete(destToSubsMap, dest)
+	fits := func() bool {
+		return len(r.heldFrames[dest]) < opts.MaxHeldMessages &&
+			(opts.MaxHeldBytes == 0 || r.heldBytes[dest]+len(frame.body) <= opts.MaxHeldBytes)
 	}
-	delete(subsToDestMap, subsID)
+
+	if !fits() {
+		switch opts.OverflowPolicy {
+		case OverflowReject:
+			r.forgetStored(frame)
+			return errorMsg(errBrokerStateMachine, "Destination is full, no subscribers to receive: "+dest)
+		case OverflowDropNewest:
+			log.Println("Dropping the message, destination is full:", dest)
+			r.forgetStored(frame)
+			return nil
+		default:
+			for !fits() {
+				oldest := r.heldFrames[dest][0]
+				r.heldFrames[dest] = r.heldFrames[dest][1:]
+				r.heldBytes[dest] -= len(oldest.body)
+				r.forgetStored(oldest)
+			}
+		}
+	}
+
+	r.holdFrame(dest, frame)
 	return nil
 }
 
-func cleanupSubscriptions(sessionID string) error {
-	if _, ok := sessToSubsMap[sessionID]; !ok {
+// removeSubscription removes the subscription of the session and requeues the messages it left unacknowledged
+func (r *registry) removeSubscription(sessionID, subsID string) error {
+	r.Lock()
+	unacked, undelivered, err := r.unsubscribe(subsKey{sessionID: sessionID, subsID: subsID})
+	r.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = r.requeue(unacked); err != nil {
+		return err
+	}
+	return r.reroute(undelivered)
+}
+
+// unsubscribe drops the subscription from the routing tables and returns the messages it left unacknowledged, and
+// those it was yet to receive. The caller must hold the lock.
+func (r *registry) unsubscribe(key subsKey) ([]*Frame, []*Frame, error) {
+	if key.subsID == "" {
+		return nil, nil, errorMsg(errBrokerStateMachine, "Missing subscription ID when removing subscription")
+	}
+	if _, ok := r.subsToDestMap[key]; !ok {
+		return nil, nil, errorMsg(errBrokerStateMachine,
+			"No such subscription present to unsubscribe, subsID: "+key.subsID)
+	}
+	dest := r.subsToDestMap[key]
+
+	info, ok := r.destToSubsMap[dest][key]
+	if !ok {
+		return nil, nil, errorMsg(errBrokerStateMachine,
+			"No such subscription for given destination, subsID: "+key.subsID)
+	}
+
+	r.sessToSubsMap[key.sessionID].Remove(key.subsID)
+	delete(r.destToSubsMap[dest], key)
+	if len(r.destToSubsMap[dest]) == 0 {
+		delete(r.destToSubsMap, dest)
+		delete(r.queueCursor, dest)
+		if isWildcardDest(dest) {
+			r.wildcardSubs.remove(dest)
+		}
+	}
+	delete(r.subsToDestMap, key)
+	unacked, undelivered := info.close()
+	return unacked, undelivered, nil
+}
+
+// cleanupSubscriptions removes all the subscriptions of the session. The messages that the session left
+// unacknowledged are requeued to the remaining subscribers of their destination.
+func (r *registry) cleanupSubscriptions(sessionID string) error {
+	r.Lock()
+	if _, ok := r.sessToSubsMap[sessionID]; !ok {
+		r.Unlock()
 		return nil
 	}
-	for _, subsID := range sessToSubsMap[sessionID].ToSlice() {
-		if err := removeSubscription(subsID.(string)); err != nil {
+
+	var unacked, undelivered []*Frame
+	for _, subsID := range r.sessToSubsMap[sessionID].ToSlice() {
+		frames, backlog, err := r.unsubscribe(subsKey{sessionID: sessionID, subsID: subsID.(string)})
+		if err != nil {
+			r.Unlock()
+			return err
+		}
+		unacked = append(unacked, frames...)
+		undelivered = append(undelivered, backlog...)
+	}
+	delete(r.sessToSubsMap, sessionID)
+	r.Unlock()
+
+	if err := r.requeue(unacked); err != nil {
+		return err
+	}
+	return r.reroute(undelivered)
+}
+
+// requeue hands the unacknowledged messages of a removed subscription to the other subscribers of their destinations
+func (r *registry) requeue(frames []*Frame) error {
+	for _, frame := range frames {
+		if err := r.redeliver(frame.getHeader(HdrKeyDestination), subsKey{}, frame); err != nil {
 			return err
 		}
 	}
-	delete(sessToSubsMap, sessionID)
 	return nil
 }
 
-func publish(frame *Frame, txID string) error {
-	dest := frame.getHeader(HdrKeyDestination)
-	if dest == "" {
-		return errorMsg(errBrokerStateMachine, "Missing entry in destToSubsMap, for key: "+dest)
+// reroute hands the queue messages that a removed subscription was yet to receive to the other subscribers. They
+// were never delivered, so unlike requeue they are not counted as redelivered. The topic messages were meant for
+// the removed subscription alone and are dropped.
+func (r *registry) reroute(frames []*Frame) error {
+	for _, frame := range frames {
+		if dest := frame.getHeader(HdrKeyDestination); r.isQueue(dest) {
+			if err := r.route(dest, "", frame); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	sendIt := func(subsID string, info *subsInfo, wg *sync.WaitGroup) {
-		info.Lock()
-		defer info.Unlock()
+// isQueue tells if the destination has the point-to-point semantics
+func (r *registry) isQueue(dest string) bool {
+	return strings.HasPrefix(dest, r.opts.QueuePrefix) || strings.HasPrefix(dest, r.opts.DeadLetterPrefix+"/")
+}
 
-		if err := info.sessionHandler.sendMessage(dest, subsID, info.nextAckNum, txID,
-			frame.headers, frame.body); err != nil {
-			log.Println(err)
-			return
+// matchSubs returns the subscriptions to receive the message sent to the destination. These are made either to the
+// destination itself or to a wildcard destination matching it, and have the selector matching the message.
+// The caller must hold the lock.
+func (r *registry) matchSubs(dest string, frame *Frame) subsToInfo {
+	subs := make(subsToInfo, len(r.destToSubsMap[dest]))
+	add := func(subsMap subsToInfo) {
+		for key, info := range subsMap {
+			if selects(info.selector, frame.headers) {
+				subs[key] = info
+			}
 		}
-		info.pendingAckBitmap.Add(info.nextAckNum)
-		info.nextAckNum++
+	}
+	add(r.destToSubsMap[dest])
+	r.wildcardSubs.match(dest, func(pattern string) {
+		add(r.destToSubsMap[pattern])
+	})
+	return subs
+}
+
+// hasRoom tells if any of the subscriptions is below its prefetch limit
+func hasRoom(subs subsToInfo) bool {
+	for _, info := range subs {
+		if !info.isFull() {
+			return true
+		}
+	}
+	return false
+}
+
+// pickQueueSubscriber selects the one subscriber of the queue destination to receive the next message, among those
+// below their prefetch limit. The caller must hold the lock.
+func (r *registry) pickQueueSubscriber(dest string, frame *Frame) (subsKey, *subsInfo) {
+	subs := r.matchSubs(dest, frame)
+	if len(subs) == 0 {
+		return subsKey{}, nil
+	}
+	keys := make([]subsKey, 0, len(subs))
+	for key := range subs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].subsID != keys[j].subsID {
+			return keys[i].subsID < keys[j].subsID
+		}
+		return keys[i].sessionID < keys[j].sessionID
+	})
+
+	start := r.queueCursor[dest] % len(keys)
+	r.queueCursor[dest] = start + 1
+
+	// Skip the subscribers at their prefetch limit, none is picked if all of them are
+	pick, found := subsKey{}, false
+	for i := 0; i < len(keys); i++ {
+		if key := keys[(start+i)%len(keys)]; !subs[key].isFull() {
+			pick, found = key, true
+			break
+		}
+	}
+	if !found {
+		return subsKey{}, nil
+	}
 
-		wg.Done()
+	// Look for a less busy subscriber, starting from the round-robin pick to break the ties
+	if r.opts.QueueDispatch == DispatchLeastLoaded {
+		least := subs[pick].pendingCount()
+		for i := 1; i < len(keys) && least > 0; i++ {
+			key := keys[(start+i)%len(keys)]
+			if n := subs[key].pendingCount(); n < least && !subs[key].isFull() {
+				pick, least = key, n
+			}
+		}
 	}
+	return pick, subs[pick]
+}
+
+func (r *registry) publish(frame *Frame, txID string) error {
+	frame, err := r.prepareMessage(frame)
+	if err != nil {
+		return err
+	}
+	if dest := frame.getHeader(HdrKeyDestination); r.isQueue(dest) {
+		return r.dispatch(dest, txID, frame)
+	}
+	return r.deliverMessage(frame, txID)
+}
+
+// prepareMessage checks the destination of the message and, for the queues, gives the message its ID
+func (r *registry) prepareMessage(frame *Frame) (*Frame, error) {
+	dest := frame.getHeader(HdrKeyDestination)
+	if dest == "" {
+		return nil, errorMsg(errBrokerStateMachine, "Missing entry in destToSubsMap, for key: "+dest)
+	}
+	if isWildcardDest(dest) {
+		return nil, errorMsg(errBrokerStateMachine, "Cannot send to a wildcard destination: "+dest)
+	}
+
+	if r.isQueue(dest) {
+		// Queue messages keep their ID across redeliveries and the restarts
+		frame = frame.clone()
+		frame.headers[HdrKeyMessageID] = uuid.NewString()
+	}
+	return frame, nil
+}
+
+// deliverMessage delivers the prepared message to one of the queue subscribers, or to all the topic subscribers.
+// The queue message is expected to be in the message store already.
+func (r *registry) deliverMessage(frame *Frame, txID string) error {
+	dest := frame.getHeader(HdrKeyDestination)
+	if r.isQueue(dest) {
+		return r.route(dest, txID, frame)
+	}
+
+	r.Lock()
+	subs := r.matchSubs(dest, frame)
+	r.Unlock()
 
 	var wg sync.WaitGroup
-	for subsID, info := range destToSubsMap[dest] {
+	for key, info := range subs {
 		wg.Add(1)
-		go sendIt(subsID, info, &wg)
+		go func(subsID string, info *subsInfo) {
+			defer wg.Done()
+			if err := info.deliver(dest, subsID, txID, frame); err != nil && !errors.Is(err, errSubsClosed) {
+				log.Println(err)
+			}
+		}(key.subsID, info)
 	}
 	wg.Wait()
 
 	return nil
 }
 
+// dispatch stores the queue message and delivers it to one of the subscribers, or holds it when there are none
+func (r *registry) dispatch(dest, txID string, frame *Frame) error {
+	if r.opts.MessageStore != nil {
+		if err := r.opts.MessageStore.Append(frame); err != nil {
+			return err
+		}
+	}
+	return r.route(dest, txID, frame)
+}
+
+// route delivers the queue message to one of the subscribers, or holds it when there are none below their prefetch
+// limit
+func (r *registry) route(dest, txID string, frame *Frame) error {
+	for {
+		r.Lock()
+		key, info := r.pickQueueSubscriber(dest, frame)
+		if info == nil {
+			err := r.bufferFrame(dest, frame)
+			r.Unlock()
+			return err
+		}
+		r.Unlock()
+
+		// Pick again if the subscription is gone or full meanwhile
+		if err := info.deliver(dest, key.subsID, txID, frame); !errors.Is(err, errSubsClosed) &&
+			!errors.Is(err, errSubsFull) {
+			return err
+		}
+	}
+}
+
+// deliver sends the frame as MESSAGE to the subscriber and, unless the subscription is in `auto` mode, keeps it
+// pending until it is acknowledged. At the prefetch limit the queue message is refused with errSubsFull, to be held
+// by its destination, while the topic message waits in the backlog. The backlog holds up to MaxHeldMessages, then
+// the SlowConsumerPolicy applies. The wait for the room in the outbound queue happens without holding the lock.
+func (info *subsInfo) deliver(dest, subsID, txID string, frame *Frame) error {
+	opts := info.sessionHandler.reg.opts
+	for {
+		info.sendMu.Lock()
+		info.Lock()
+		if info.closed {
+			info.Unlock()
+			info.sendMu.Unlock()
+			return errSubsClosed
+		}
+		if !info.full() {
+			data, err := info.send(dest, subsID, txID, frame)
+			info.Unlock()
+			if err == nil {
+				info.flush([][]byte{data})
+			}
+			info.sendMu.Unlock()
+			return err
+		}
+		if info.sessionHandler.reg.isQueue(dest) {
+			info.Unlock()
+			info.sendMu.Unlock()
+			return errSubsFull
+		}
+		if len(info.backlog) < opts.MaxHeldMessages {
+			info.backlog = append(info.backlog, &backlogFrame{dest: dest, subsID: subsID, txID: txID, frame: frame})
+			info.count()
+			info.Unlock()
+			info.sendMu.Unlock()
+			return nil
+		}
+		room := info.room
+		info.Unlock()
+		info.sendMu.Unlock()
+
+		switch opts.SlowConsumerPolicy {
+		case SlowConsumerDrop:
+			log.Println("Backlog full, dropping the message for the session:", info.sessionHandler.sessionID)
+			return nil
+		case SlowConsumerDisconnect:
+			log.Println("Backlog full, disconnecting the slow session:", info.sessionHandler.sessionID)
+			_ = info.sessionHandler.conn.Close()
+			return nil
+		default:
+			<-room
+		}
+	}
+}
+
+// makeRoom wakes up the deliveries waiting for the room in the backlog. The caller must hold the lock.
+func (info *subsInfo) makeRoom() {
+	close(info.room)
+	info.room = make(chan struct{})
+}
+
+// send prepares the frame as MESSAGE to the subscriber, to be queued by flush. The caller must hold the lock.
+func (info *subsInfo) send(dest, subsID, txID string, frame *Frame) ([]byte, error) {
+	data, err := info.sessionHandler.messageFrame(dest, subsID, info.nextAckNum, txID, frame.headers, frame.body)
+	if err != nil {
+		return nil, err
+	}
+	if info.ackMode != HdrValAckAuto {
+		info.pendingAckBitmap.Add(info.nextAckNum)
+		info.pendingFrames[info.nextAckNum] = frame
+		info.count()
+	} else {
+		info.sessionHandler.reg.forgetStored(frame)
+	}
+	info.nextAckNum++
+	return data, nil
+}
+
+// flush queues the MESSAGE frames for the subscriber. The caller must hold the sendMu, but not the lock.
+func (info *subsInfo) flush(frames [][]byte) {
+	for _, data := range frames {
+		info.sessionHandler.enqueue(data, info.sessionHandler.reg.opts.SlowConsumerPolicy)
+	}
+}
+
+// drain prepares the messages from the backlog as long as the prefetch limit allows, to be queued by flush.
+// The caller must hold the lock.
+func (info *subsInfo) drain() [][]byte {
+	var frames [][]byte
+	for len(info.backlog) > 0 && info.pendingAckBitmap.GetCardinality() < info.prefetch {
+		b := info.backlog[0]
+		data, err := info.send(b.dest, b.subsID, b.txID, b.frame)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		frames = append(frames, data)
+		info.backlog = info.backlog[1:]
+	}
+	info.count()
+	return frames
+}
+
+// count publishes the counts of the pending and the backlog messages, for the lock-free dispatch decisions.
+// The caller must hold the lock.
+func (info *subsInfo) count() {
+	atomic.StoreInt64(&info.pending, int64(info.pendingAckBitmap.GetCardinality()))
+	atomic.StoreInt64(&info.queued, int64(len(info.backlog)))
+}
+
+// isFull tells if the subscription is at its prefetch limit, without taking the lock
+func (info *subsInfo) isFull() bool {
+	return info.prefetch > 0 &&
+		(atomic.LoadInt64(&info.queued) > 0 || uint64(atomic.LoadInt64(&info.pending)) >= info.prefetch)
+}
+
+// full tells if the subscription is at its prefetch limit. The caller must hold the lock.
+func (info *subsInfo) full() bool {
+	return info.prefetch > 0 && (len(info.backlog) > 0 || info.pendingAckBitmap.GetCardinality() >= info.prefetch)
+}
+
+// close marks the subscription as removed and returns the messages that are still pending acknowledgement, and
+// those waiting in the backlog
+func (info *subsInfo) close() ([]*Frame, []*Frame) {
+	info.Lock()
+	defer info.Unlock()
+
+	info.closed = true
+	frames := make([]*Frame, 0, info.pendingAckBitmap.GetCardinality())
+	for it := info.pendingAckBitmap.Iterator(); it.HasNext(); {
+		frames = append(frames, info.pendingFrames[it.Next()])
+	}
+	info.pendingAckBitmap.Clear()
+	info.pendingFrames = map[uint32]*Frame{}
+
+	backlog := make([]*Frame, 0, len(info.backlog))
+	for _, b := range info.backlog {
+		backlog = append(backlog, b.frame)
+	}
+	info.backlog = nil
+	info.count()
+	info.makeRoom()
+	return frames, backlog
+}
+
+// forgetStored deletes the message from the message store once it is done with
+func (r *registry) forgetStored(frame *Frame) {
+	if r.opts.MessageStore == nil || !r.isQueue(frame.getHeader(HdrKeyDestination)) {
+		return
+	}
+	if err := r.opts.MessageStore.Delete(frame.getHeader(HdrKeyMessageID)); err != nil {
+		log.Println(err)
+	}
+}
+
+// pendingCount returns the number of messages delivered to the subscriber and not yet acknowledged, without taking
+// the lock
+func (info *subsInfo) pendingCount() uint64 {
+	return uint64(atomic.LoadInt64(&info.pending))
+}
+
+// settle removes the acknowledged messages from the pending set and returns their frames. For the `client` mode
+// the acknowledgement is cumulative: it covers every pending message up to and including ackNum.
+// The caller must hold the lock.
+func (info *subsInfo) settle(ackNum uint32) []*Frame {
+	var nums []uint32
+	switch info.ackMode {
+	case HdrValAckClient:
+		for it := info.pendingAckBitmap.Iterator(); it.HasNext(); {
+			n := it.Next()
+			if n > ackNum {
+				break
+			}
+			nums = append(nums, n)
+		}
+	case HdrValAckClientIndividual:
+		if info.pendingAckBitmap.Contains(ackNum) {
+			nums = append(nums, ackNum)
+		}
+	}
+
+	frames := make([]*Frame, 0, len(nums))
+	for _, n := range nums {
+		info.pendingAckBitmap.Remove(n)
+		frames = append(frames, info.pendingFrames[n])
+		delete(info.pendingFrames, n)
+	}
+	info.count()
+	if len(nums) > 0 {
+		info.makeRoom()
+	}
+	return frames
+}
+
+// fmtAckNum formats the ack value as `<dest>:<subsID>:<len(subsID)>:<ackNum>`. The length of the subscription ID
+// tells it apart from the destination, as both may contain ':'.
 func fmtAckNum(dest, subsID string, ackNum uint32) string {
-	return fmt.Sprintf("%s:%s:%d", dest, subsID, ackNum)
+	return fmt.Sprintf("%s:%s:%d:%d", dest, subsID, len(subsID), ackNum)
 }
 
+// scanAckNum parses the ack value formatted by fmtAckNum, from the right
 func scanAckNum(fmtAck string) (dest string, subsID string, ackNum uint32, err error) {
-	parts := strings.Split(fmtAck, ":")
-	var n int
-	n, err = strconv.Atoi(parts[2])
+	invalid := errorMsg(errBrokerStateMachine, "Invalid ack value: "+fmtAck)
+	i := strings.LastIndexByte(fmtAck, ':')
+	if i < 0 {
+		return "", "", 0, invalid
+	}
+	n, err := strconv.ParseUint(fmtAck[i+1:], 10, 32)
 	if err != nil {
-		return "", "", 0, err
+		return "", "", 0, invalid
+	}
+	rest := fmtAck[:i]
+	if i = strings.LastIndexByte(rest, ':'); i < 0 {
+		return "", "", 0, invalid
 	}
-	if n < 0 {
-		err = errorMsg(errBrokerStateMachine, "Invalid ack value: "+fmtAck)
-		return "", "", 0, err
+	subsLen, err := strconv.Atoi(rest[i+1:])
+	if err != nil || subsLen < 0 || subsLen+1 > i {
+		return "", "", 0, invalid
 	}
-	return parts[0], parts[1], uint32(n), nil
+	rest = rest[:i]
+	if rest[len(rest)-subsLen-1] != ':' {
+		return "", "", 0, invalid
+	}
+	return rest[:len(rest)-subsLen-1], rest[len(rest)-subsLen:], uint32(n), nil
 }
 
-func processAck(ackVal string) error {
-	dest, subsID, ackNum, err := scanAckNum(ackVal)
+// getSubsInfo looks up the subscription of the session by its ID. The destination in the ack value is that of the
+// message, which differs from the subscribed one for the wildcard subscriptions.
+func (r *registry) getSubsInfo(sessionID, subsID string) (*subsInfo, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	key := subsKey{sessionID: sessionID, subsID: subsID}
+	dest, ok := r.subsToDestMap[key]
+	if !ok {
+		return nil, errorMsg(errBrokerStateMachine, "Missing entry in subsToDestMap, for key: "+subsID)
+	}
+	if _, ok := r.destToSubsMap[dest]; !ok {
+		return nil, errorMsg(errBrokerStateMachine, "Missing entry in destToSubsMap, for key: "+dest)
+	}
+
+	if _, ok := r.destToSubsMap[dest][key]; !ok {
+		return nil, errorMsg(errBrokerStateMachine, "Missing entry in destToSubsMap, for key: "+dest+"/"+subsID)
+	}
+	return r.destToSubsMap[dest][key], nil
+}
+
+// acknowledge settles the message(s) acknowledged by the ACK or rejected by the NACK frame of the session
+func (r *registry) acknowledge(sessionID string, frame *Frame) error {
+	if frame.command == CmdNack {
+		return r.processNack(sessionID, frame.getHeader(HdrKeyID))
+	}
+	return r.processAck(sessionID, frame.getHeader(HdrKeyID))
+}
+
+func (r *registry) processAck(sessionID, ackVal string) error {
+	_, subsID, ackNum, err := scanAckNum(ackVal)
+	if err != nil {
+		return err
+	}
+
+	info, err := r.getSubsInfo(sessionID, subsID)
 	if err != nil {
-		return errorMsg(errBrokerStateMachine, "Invalid ACK value: "+ackVal)
+		return err
 	}
+	info.sendMu.Lock()
+	info.Lock()
+	frames := info.settle(ackNum)
+	backlog := info.drain()
+	info.Unlock()
+	info.flush(backlog)
+	info.sendMu.Unlock()
 
-	if _, ok := destToSubsMap[dest]; !ok {
-		return errorMsg(errBrokerStateMachine, "Missing entry in destToSubsMap, for key: "+dest)
+	for _, frame := range frames {
+		r.forgetStored(frame)
 	}
+	r.pullHeldFrames(subsKey{sessionID: sessionID, subsID: subsID}, info)
+	return nil
+}
 
-	if _, ok := destToSubsMap[dest][subsID]; !ok {
-		return errorMsg(errBrokerStateMachine, "Missing entry in destToSubsMap, for key: "+dest+"/"+subsID)
+// processNack hands the rejected message(s) back to the destination for redelivery
+func (r *registry) processNack(sessionID, ackVal string) error {
+	_, subsID, ackNum, err := scanAckNum(ackVal)
+	if err != nil {
+		return err
 	}
 
-	info := destToSubsMap[dest][subsID]
+	info, err := r.getSubsInfo(sessionID, subsID)
+	if err != nil {
+		return err
+	}
+	info.sendMu.Lock()
 	info.Lock()
-	defer info.Unlock()
-	if info.ackMode == HdrValAckClient {
-		for i := info.pendingAckBitmap.Minimum(); info.pendingAckBitmap.Contains(i); i++ {
-			info.pendingAckBitmap.Remove(i)
+	frames := info.settle(ackNum)
+	backlog := info.drain()
+	info.Unlock()
+	info.flush(backlog)
+	info.sendMu.Unlock()
+
+	// The cumulative NACK of a wildcard subscription covers the messages of several destinations
+	for _, frame := range frames {
+		dest := frame.getHeader(HdrKeyDestination)
+		if err = r.redeliver(dest, subsKey{sessionID: sessionID, subsID: subsID}, frame); err != nil {
+			return err
 		}
-	} else if info.ackMode == HdrValAckClientIndividual {
-		info.pendingAckBitmap.Remove(ackNum)
 	}
+	r.pullHeldFrames(subsKey{sessionID: sessionID, subsID: subsID}, info)
 	return nil
 }
 
-// func processNack(ackVal string) error {
-// 	// Do nothing
-// 	return nil
-// }
+// redeliver sends the unacknowledged message again, preferably to a subscriber other than the one that rejected it.
+// The topic message goes back to the subscriber that rejected it only. The `redelivery-count` header is incremented
+// on each attempt, and once it exceeds the MaxRedeliveries the message is published to the dead-letter destination
+// instead, with the count starting over. The messages of the dead-letter destinations are never dead-lettered again.
+// With no subscriber left the queue message is held for the next one, the topic message is dropped.
+func (r *registry) redeliver(dest string, nackKey subsKey, frame *Frame) error {
+	f := frame.clone()
+	count, _ := strconv.Atoi(f.getHeader(HdrKeyRedeliveryCount))
+	count++
+	f.headers[HdrKeyRedeliveryCount] = strconv.Itoa(count)
+
+	if count > r.opts.MaxRedeliveries && !strings.HasPrefix(dest, r.opts.DeadLetterPrefix+"/") {
+		r.forgetStored(frame)
+		delete(f.headers, HdrKeyRedeliveryCount)
+		f.headers[HdrKeyOriginalDestination] = dest
+		f.headers[HdrKeyDestination] = r.opts.DeadLetterPrefix + dest
+		return r.publish(f, "")
+	}
+
+	for {
+		r.Lock()
+		key, info := r.pickRedeliverySubscriber(dest, nackKey, f)
+		if info == nil {
+			if r.isQueue(dest) {
+				r.holdFrame(dest, f)
+			}
+			r.Unlock()
+			return nil
+		}
+		r.Unlock()
+
+		// Pick again if the subscription is gone or full meanwhile
+		if err := info.deliver(dest, key.subsID, "", f); !errors.Is(err, errSubsClosed) &&
+			!errors.Is(err, errSubsFull) {
+			return err
+		}
+	}
+}
+
+// pickRedeliverySubscriber selects a subscriber of dest other than the excluded one. It falls back to the excluded
+// subscriber if that is the only one left with room. For the topics, whose every other subscriber got its own copy
+// of the message, only the excluded subscriber is eligible. The caller must hold the lock.
+func (r *registry) pickRedeliverySubscriber(dest string, exclude subsKey, frame *Frame) (subsKey, *subsInfo) {
+	subs := r.matchSubs(dest, frame)
+	if !r.isQueue(dest) {
+		if info, ok := subs[exclude]; ok {
+			return exclude, info
+		}
+		return subsKey{}, nil
+	}
+
+	// The queue subscribers at their prefetch limit are skipped, the message is held if all of them are
+	for key, info := range subs {
+		if key != exclude && !info.isFull() {
+			return key, info
+		}
+	}
+	if info, ok := subs[exclude]; ok && !info.isFull() {
+		return exclude, info
+	}
+	return subsKey{}, nil
+}
@@ -1,7 +1,14 @@
 package stomp
 
 import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func Test_readAck(t *testing.T) {
@@ -12,4 +19,839 @@ func Test_readAck(t *testing.T) {
 	if dest != "/queue/x" || subsID != "3f9e7c9deb0a" || ackNum != 10 {
 		t.Error(dest, subsID, ackNum)
 	}
+
+	// The destination and the subscription ID may contain ':'
+	dest, subsID, ackNum, err = scanAckNum(fmtAckNum("/queue/a:b", "s:1", 7))
+	if err != nil || dest != "/queue/a:b" || subsID != "s:1" || ackNum != 7 {
+		t.Error(dest, subsID, ackNum, err)
+	}
+
+	for _, ackVal := range []string{"", "foo", "x:1", "/queue/x:s:1", "/queue/x:s:-1:1", "/queue/x:s:9:1",
+		"/queue/x:s:1:-1", "/queue/x:s:1:z", "/queue/xs:1:1"} {
+		if _, _, _, err = scanAckNum(ackVal); err == nil {
+			t.Error("expected error for the ack value:", ackVal)
+		}
+	}
+}
+
+func newTestRegistry() *registry {
+	return newRegistry(&BrokerOpts{
+		MaxRedeliveries:  DefaultMaxRedeliveries,
+		DeadLetterPrefix: DefaultDeadLetterPrefix,
+		QueuePrefix:      DefaultQueuePrefix,
+		QueueDispatch:    DispatchRoundRobin,
+		MaxHeldMessages:  DefaultMaxHeldMessages,
+		OverflowPolicy:   OverflowDropOldest,
+	})
+}
+
+// newTestSession returns a broker session whose outgoing frames are delivered over the returned channel
+func newTestSession(t *testing.T, reg *registry) (*Session, <-chan *Frame) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+
+	ch := make(chan *Frame, 100)
+	go func() {
+		for raw := range frameScanner(client) {
+			f, err := NewFrameFromBytes(raw)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			ch <- f
+		}
+		close(ch)
+	}()
+	return newSession(server, reg, &sync.WaitGroup{}), ch
+}
+
+func recvFrame(t *testing.T, ch <-chan *Frame) *Frame {
+	select {
+	case f := <-ch:
+		return f
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for frame")
+	}
+	return nil
+}
+
+func TestProcessNack(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.MaxRedeliveries = 1
+	dest := "/queue/nack"
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	sessDLQ, chDLQ := newTestSession(t, reg)
+
+	if err := reg.addSubscription(dest, "nack-a", HdrValAckClientIndividual, "", 0, sessA); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.addSubscription(DefaultDeadLetterPrefix+dest, "nack-dlq", HdrValAckAuto, "", 0, sessDLQ); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = reg.cleanupSubscriptions(sessA.sessionID)
+		_ = reg.cleanupSubscriptions(sessB.sessionID)
+		_ = reg.cleanupSubscriptions(sessDLQ.sessionID)
+	}()
+
+	if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte("hello")), ""); err != nil {
+		t.Fatal(err)
+	}
+	msg := recvFrame(t, chA)
+
+	// First NACK redelivers to the other subscriber
+	if err := reg.addSubscription(dest, "nack-b", HdrValAckClient, "", 0, sessB); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.processNack(sessA.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	msg = recvFrame(t, chB)
+	if msg.getHeader(HdrKeyRedeliveryCount) != "1" || string(msg.body) != "hello" {
+		t.Error(msg)
+	}
+
+	// Second NACK exceeds the limit and moves the message to the dead-letter queue
+	if err := reg.processNack(sessB.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	msg = recvFrame(t, chDLQ)
+	if msg.getHeader(HdrKeyDestination) != DefaultDeadLetterPrefix+dest ||
+		msg.getHeader(HdrKeyOriginalDestination) != dest {
+		t.Error(msg)
+	}
+
+	if err := reg.processNack(sessA.sessionID, fmtAckNum(dest, "nack-x", 0)); err == nil {
+		t.Error("expected error for unknown subscription")
+	}
+}
+
+func TestDeadLetterNack(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.MaxRedeliveries = 0
+	dest := "/queue/dlq-nack"
+	sess, ch := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+	if err := reg.addSubscription(dest, "dlq-nack", HdrValAckClientIndividual, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	dlq := DefaultDeadLetterPrefix + dest
+	if err := reg.addSubscription(dlq, "dlq-nack-dlq", HdrValAckClientIndividual, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte("dead")), ""); err != nil {
+		t.Fatal(err)
+	}
+	msg := recvFrame(t, ch)
+	if err := reg.processNack(sess.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	msg = recvFrame(t, ch)
+	if msg.getHeader(HdrKeyDestination) != dlq || msg.getHeader(HdrKeyRedeliveryCount) != "" {
+		t.Error(msg)
+	}
+
+	// The NACKed dead letter is redelivered, it stays in the dead-letter queue
+	for i := 1; i <= 2; i++ {
+		if err := reg.processNack(sess.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+			t.Fatal(err)
+		}
+		msg = recvFrame(t, ch)
+		if msg.getHeader(HdrKeyDestination) != dlq || msg.getHeader(HdrKeyOriginalDestination) != dest ||
+			msg.getHeader(HdrKeyRedeliveryCount) != strconv.Itoa(i) {
+			t.Error(msg)
+		}
+	}
+}
+
+func TestMalformedAck(t *testing.T) {
+	reg := newTestRegistry()
+	sess, _ := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+	// The malformed ack values are answered with ERROR, whether in a transaction or not
+	for _, cmd := range []Command{CmdAck, CmdNack} {
+		if err := sess.stateMachine(NewFrame(cmd, map[Header]string{HdrKeyID: "foo"}, nil)); err == nil {
+			t.Error("expected error for the malformed", cmd)
+		}
+	}
+	inTx := func(cmd Command, h map[Header]string) error {
+		h[HdrKeyTransaction] = "tx-malformed"
+		return sess.stateMachine(NewFrame(cmd, h, nil))
+	}
+	if err := inTx(CmdBegin, map[Header]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inTx(CmdNack, map[Header]string{HdrKeyID: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inTx(CmdCommit, map[Header]string{}); err == nil {
+		t.Error("expected error committing the malformed NACK")
+	}
+}
+
+func TestTopicNack(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.MaxRedeliveries = 1
+	dest := "/topic/nack"
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	sessDLQ, chDLQ := newTestSession(t, reg)
+	defer func() {
+		_ = reg.cleanupSubscriptions(sessA.sessionID)
+		_ = reg.cleanupSubscriptions(sessB.sessionID)
+		_ = reg.cleanupSubscriptions(sessDLQ.sessionID)
+	}()
+
+	for _, sess := range []*Session{sessA, sessB} {
+		if err := reg.addSubscription(dest, "topic-nack", HdrValAckClientIndividual, "", 0, sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.addSubscription(DefaultDeadLetterPrefix+dest, "nack-dlq", HdrValAckAuto, "", 0, sessDLQ); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte("hello")), ""); err != nil {
+		t.Fatal(err)
+	}
+	msg := recvFrame(t, chA)
+	recvFrame(t, chB)
+
+	// The other subscriber already has its copy, the NACKing one gets the message again
+	if err := reg.processNack(sessA.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	if msg = recvFrame(t, chA); msg.getHeader(HdrKeyRedeliveryCount) != "1" {
+		t.Error(msg)
+	}
+	select {
+	case f := <-chB:
+		t.Error("unexpected duplicate:", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Beyond the limit it goes to the dead-letter destination
+	if err := reg.processNack(sessA.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	if msg = recvFrame(t, chDLQ); msg.getHeader(HdrKeyOriginalDestination) != dest {
+		t.Error(msg)
+	}
+}
+
+func TestWildcardNack(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.MaxRedeliveries = 0
+	sess, ch := newTestSession(t, reg)
+	sessDLQ, chDLQ := newTestSession(t, reg)
+	defer func() {
+		_ = reg.cleanupSubscriptions(sess.sessionID)
+		_ = reg.cleanupSubscriptions(sessDLQ.sessionID)
+	}()
+
+	if err := reg.addSubscription("/queue/multi.*", "multi", HdrValAckClient, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.addSubscription(DefaultDeadLetterPrefix+"/queue/multi.*", "multi-dlq", HdrValAckAuto, "", 0,
+		sessDLQ); err != nil {
+		t.Fatal(err)
+	}
+	dests := []string{"/queue/multi.a", "/queue/multi.b"}
+	for _, dest := range dests {
+		if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, nil), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recvFrame(t, ch)
+	last := recvFrame(t, ch)
+
+	// The cumulative NACK moves each message to the dead-letter destination of its own
+	if err := reg.processNack(sess.sessionID, last.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for range dests {
+		msg := recvFrame(t, chDLQ)
+		got[msg.getHeader(HdrKeyDestination)] = msg.getHeader(HdrKeyOriginalDestination)
+	}
+	want := map[string]string{
+		DefaultDeadLetterPrefix + dests[0]: dests[0],
+		DefaultDeadLetterPrefix + dests[1]: dests[1],
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCleanupSubscriptionsRequeue(t *testing.T) {
+	reg := newTestRegistry()
+	dest := "/queue/requeue"
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	sessC, chC := newTestSession(t, reg)
+
+	if err := reg.addSubscription(dest, "requeue-a", HdrValAckClient, "", 0, sessA); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte("one")), ""); err != nil {
+		t.Fatal(err)
+	}
+	recvFrame(t, chA)
+
+	// Requeued to the remaining subscriber
+	if err := reg.addSubscription(dest, "requeue-b", HdrValAckClientIndividual, "", 0, sessB); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.cleanupSubscriptions(sessA.sessionID); err != nil {
+		t.Fatal(err)
+	}
+	msg := recvFrame(t, chB)
+	if string(msg.body) != "one" || msg.getHeader(HdrKeyRedeliveryCount) != "1" {
+		t.Error(msg)
+	}
+
+	// Held until the next subscriber arrives
+	if err := reg.cleanupSubscriptions(sessB.sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.heldFrames[dest]) != 1 {
+		t.Fatal(reg.heldFrames[dest])
+	}
+	if err := reg.addSubscription(dest, "requeue-c", HdrValAckAuto, "", 0, sessC); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = reg.cleanupSubscriptions(sessC.sessionID) }()
+	if msg = recvFrame(t, chC); string(msg.body) != "one" || msg.getHeader(HdrKeyRedeliveryCount) != "2" {
+		t.Error(msg)
+	}
+	if _, ok := reg.heldFrames[dest]; ok {
+		t.Error(reg.heldFrames[dest])
+	}
+}
+
+func TestSameSubscriptionID(t *testing.T) {
+	reg := newTestRegistry()
+	dest := "/topic/same-id"
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sessB.sessionID) }()
+
+	// The subscription IDs are per session, both get the message
+	for _, sess := range []*Session{sessA, sessB} {
+		if err := reg.addSubscription(dest, "sub-0", HdrValAckClientIndividual, "", 0, sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte("hi")), ""); err != nil {
+		t.Fatal(err)
+	}
+	a, b := recvFrame(t, chA), recvFrame(t, chB)
+
+	// The ACK of one session does not settle the message of the other
+	if err := reg.processAck(sessA.sessionID, b.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	infoA, _ := reg.getSubsInfo(sessA.sessionID, "sub-0")
+	infoB, _ := reg.getSubsInfo(sessB.sessionID, "sub-0")
+	if infoA.pendingCount() != 0 || infoB.pendingCount() != 1 {
+		t.Error("pending:", infoA.pendingCount(), infoB.pendingCount())
+	}
+
+	// Removing the subscriptions of one session leaves those of the other
+	if err := reg.cleanupSubscriptions(sessA.sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.getSubsInfo(sessA.sessionID, "sub-0"); err == nil {
+		t.Error("expected the subscription of the session to be removed")
+	}
+	if _, err := reg.getSubsInfo(sessB.sessionID, "sub-0"); err != nil {
+		t.Error(err)
+	}
+	if err := reg.removeSubscription(sessA.sessionID, "sub-0"); err == nil {
+		t.Error("expected error removing the subscription of the other session")
+	}
+	if err := reg.processAck(sessB.sessionID, a.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	if infoB.pendingCount() != 0 {
+		t.Error("pending:", infoB.pendingCount())
+	}
+}
+
+func TestPublishQueueAndTopic(t *testing.T) {
+	reg := newTestRegistry()
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	defer func() {
+		_ = reg.cleanupSubscriptions(sessA.sessionID)
+		_ = reg.cleanupSubscriptions(sessB.sessionID)
+	}()
+
+	send := func(dest, body string) {
+		if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(body)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Round-robin between the queue subscribers
+	queue := "/queue/dispatch"
+	for _, sub := range []struct {
+		id   string
+		sess *Session
+	}{{"dispatch-a", sessA}, {"dispatch-b", sessB}} {
+		if err := reg.addSubscription(queue, sub.id, HdrValAckClientIndividual, "", 0, sub.sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(queue, "1")
+	send(queue, "2")
+	if a, b := recvFrame(t, chA), recvFrame(t, chB); string(a.body) != "1" || string(b.body) != "2" {
+		t.Error(a, b)
+	}
+
+	// Least-loaded prefers the subscriber that acknowledged its message
+	reg.opts.QueueDispatch = DispatchLeastLoaded
+	info, _ := reg.getSubsInfo(sessB.sessionID, "dispatch-b")
+	info.Lock()
+	info.settle(0)
+	info.Unlock()
+	send(queue, "3")
+	if b := recvFrame(t, chB); string(b.body) != "3" {
+		t.Error(b)
+	}
+
+	// Fan-out to all the topic subscribers
+	topic := "/topic/fanout"
+	if err := reg.addSubscription(topic, "fanout-a", HdrValAckAuto, "", 0, sessA); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.addSubscription(topic, "fanout-b", HdrValAckAuto, "", 0, sessB); err != nil {
+		t.Fatal(err)
+	}
+	send(topic, "all")
+	if a, b := recvFrame(t, chA), recvFrame(t, chB); string(a.body) != "all" || string(b.body) != "all" {
+		t.Error(a, b)
+	}
+}
+
+func TestBufferFrameOverflow(t *testing.T) {
+	tests := []struct {
+		policy  OverflowPolicy
+		held    []string
+		wantErr bool
+	}{
+		{OverflowDropOldest, []string{"2", "3"}, false},
+		{OverflowDropNewest, []string{"1", "2"}, false},
+		{OverflowReject, []string{"1", "2"}, true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			reg := newTestRegistry()
+			reg.opts.MaxHeldMessages = 2
+			reg.opts.OverflowPolicy = test.policy
+			dest := "/queue/held-" + string(test.policy)
+
+			var err error
+			for _, body := range []string{"1", "2", "3"} {
+				err = reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(body)), "")
+			}
+			if (err != nil) != test.wantErr {
+				t.Error(err)
+			}
+
+			// Forwarded to the first subscriber
+			sess, ch := newTestSession(t, reg)
+			if err = reg.addSubscription(dest, "held-"+string(test.policy), HdrValAckAuto, "", 0, sess); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+			for _, body := range test.held {
+				if msg := recvFrame(t, ch); string(msg.body) != body {
+					t.Error(msg)
+				}
+			}
+		})
+	}
+
+	// Bounded by size
+	reg := newTestRegistry()
+	reg.opts.MaxHeldBytes = 4
+	dest := "/queue/held-bytes"
+	for _, body := range []string{"abc", "de", "fghij"} {
+		err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(body)), "")
+		if (err != nil) != (body == "fghij") {
+			t.Error(body, err)
+		}
+	}
+	if len(reg.heldFrames[dest]) != 1 || string(reg.heldFrames[dest][0].body) != "de" || reg.heldBytes[dest] != 2 {
+		t.Error(reg.heldFrames[dest], reg.heldBytes[dest])
+	}
+}
+
+func TestWildcardSubscription(t *testing.T) {
+	reg := newTestRegistry()
+	sess, ch := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+	// Held queue message is released to the matching wildcard subscriber
+	held := NewFrame(CmdSend, map[Header]string{HdrKeyDestination: "/queue/orders.eu"}, []byte("held"))
+	if err := reg.publish(held, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.addSubscription("/queue/orders.*", "wild-q", HdrValAckClient, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	msg := recvFrame(t, ch)
+	if string(msg.body) != "held" || msg.getHeader(HdrKeyDestination) != "/queue/orders.eu" {
+		t.Fatal(msg)
+	}
+	if err := reg.processAck(sess.sessionID, msg.getHeader(HdrKeyAck)); err != nil {
+		t.Error(err)
+	}
+
+	if err := reg.addSubscription("/topic/orders.>", "wild-t", HdrValAckAuto, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{"/topic/orders.eu.new", "/topic/stock.eu", "/topic/orders.us"} {
+		if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(dest)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a, b := recvFrame(t, ch), recvFrame(t, ch); string(a.body) != "/topic/orders.eu.new" ||
+		string(b.body) != "/topic/orders.us" {
+		t.Error(a, b)
+	}
+
+	if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: "/topic/orders.*"}, nil), ""); err == nil {
+		t.Error("expected error sending to a wildcard destination")
+	}
+	if err := reg.addSubscription("/topic/>.new", "bad", HdrValAckAuto, "", 0, sess); err == nil {
+		t.Error("expected error for '>' in the middle")
+	}
+
+	if err := reg.removeSubscription(sess.sessionID, "wild-t"); err != nil {
+		t.Error(err)
+	}
+	if len(reg.wildcardSubs.children) != 1 {
+		t.Error("trie not pruned:", reg.wildcardSubs.children)
+	}
+}
+
+func TestSelectorSubscription(t *testing.T) {
+	reg := newTestRegistry()
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	defer func() {
+		_ = reg.cleanupSubscriptions(sessA.sessionID)
+		_ = reg.cleanupSubscriptions(sessB.sessionID)
+	}()
+
+	if err := reg.addSubscription("/topic/sel", "sel-bad", HdrValAckAuto, "priority >", 0, sessA); err == nil {
+		t.Error("expected error for invalid selector")
+	}
+	if err := reg.addSubscription("/topic/sel", "sel-a", HdrValAckAuto, "priority > 5", 0, sessA); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.addSubscription("/queue/sel", "sel-b", HdrValAckAuto, "region = 'eu'", 0, sessB); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(dest, body string, headers map[Header]string) {
+		headers[HdrKeyDestination] = dest
+		if err := reg.publish(NewFrame(CmdSend, headers, []byte(body)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("/topic/sel", "low", map[Header]string{"priority": "1"})
+	send("/topic/sel", "high", map[Header]string{"priority": "9"})
+	if msg := recvFrame(t, chA); string(msg.body) != "high" {
+		t.Error(msg)
+	}
+
+	// The queue message not selected by the subscriber is held for the next one
+	send("/queue/sel", "us", map[Header]string{"region": "us"})
+	send("/queue/sel", "eu", map[Header]string{"region": "eu"})
+	if msg := recvFrame(t, chB); string(msg.body) != "eu" {
+		t.Error(msg)
+	}
+	if err := reg.addSubscription("/queue/sel", "sel-c", HdrValAckAuto, "region = 'us'", 0, sessA); err != nil {
+		t.Fatal(err)
+	}
+	if msg := recvFrame(t, chA); string(msg.body) != "us" {
+		t.Error(msg)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	reg := newTestRegistry()
+	sessA, chA := newTestSession(t, reg)
+	sessB, chB := newTestSession(t, reg)
+	defer func() {
+		_ = reg.cleanupSubscriptions(sessA.sessionID)
+		_ = reg.cleanupSubscriptions(sessB.sessionID)
+	}()
+
+	send := func(body string) {
+		f := NewFrame(CmdSend, map[Header]string{HdrKeyDestination: "/queue/prefetch"}, []byte(body))
+		if err := reg.publish(f, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectNone := func(ch <-chan *Frame) {
+		select {
+		case f := <-ch:
+			t.Error("unexpected frame beyond the prefetch limit:", f)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if err := reg.addSubscription("/queue/prefetch", "prefetch-a", HdrValAckClientIndividual, "", 1, sessA); err != nil {
+		t.Fatal(err)
+	}
+	send("1")
+	first := recvFrame(t, chA)
+	send("2")
+	expectNone(chA)
+	if n := len(reg.heldFrames["/queue/prefetch"]); n != 1 {
+		t.Error("held:", n)
+	}
+
+	// The message held while the subscribers are at their limit goes to the one with room
+	if err := reg.addSubscription("/queue/prefetch", "prefetch-b", HdrValAckClientIndividual, "", 1, sessB); err != nil {
+		t.Fatal(err)
+	}
+	last := recvFrame(t, chB)
+	if string(last.body) != "2" {
+		t.Error(last)
+	}
+	send("3")
+	expectNone(chA)
+	expectNone(chB)
+
+	// The ACK makes room for the held message
+	if err := reg.processAck(sessA.sessionID, first.getHeader(HdrKeyAck)); err != nil {
+		t.Fatal(err)
+	}
+	if a := recvFrame(t, chA); string(a.body) != "3" {
+		t.Error(a)
+	}
+
+	// The messages left by a removed subscriber go to the others, those never delivered not counted as redelivered
+	send("4")
+	send("5")
+	if err := reg.removeSubscription(sessA.sessionID, "prefetch-a"); err != nil {
+		t.Fatal(err)
+	}
+	received := map[string]string{}
+	for i := 0; i < 3; i++ {
+		if err := reg.processAck(sessB.sessionID, last.getHeader(HdrKeyAck)); err != nil {
+			t.Fatal(err)
+		}
+		last = recvFrame(t, chB)
+		received[string(last.body)] = last.getHeader(HdrKeyRedeliveryCount)
+	}
+	if diff := cmp.Diff(map[string]string{"3": "1", "4": "", "5": ""}, received); diff != "" {
+		t.Error(diff)
+	}
+
+	// The held messages stay within MaxHeldMessages
+	reg.opts.MaxHeldMessages = 2
+	for _, body := range []string{"6", "7", "8"} {
+		send(body)
+	}
+	if held := reg.heldFrames["/queue/prefetch"]; len(held) != 2 || string(held[0].body) != "7" {
+		t.Error("held:", held)
+	}
+}
+
+func TestTopicBacklog(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{SlowConsumerDrop, SlowConsumerBlock} {
+		t.Run(string(policy), func(t *testing.T) {
+			reg := newTestRegistry()
+			reg.opts.MaxHeldMessages = 1
+			reg.opts.SlowConsumerPolicy = policy
+			reg.opts.OutboundQueueSize = 10
+			sess, ch := newTestSession(t, reg)
+			defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+			dest := "/topic/backlog-" + string(policy)
+			if err := reg.addSubscription(dest, "backlog", HdrValAckClientIndividual, "", 1, sess); err != nil {
+				t.Fatal(err)
+			}
+			publish := func(body string) <-chan error {
+				published := make(chan error, 1)
+				f := NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, []byte(body))
+				go func() { published <- reg.publish(f, "") }()
+				return published
+			}
+
+			// One message is delivered, one waits in the backlog
+			for _, body := range []string{"1", "2"} {
+				if err := <-publish(body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			first := recvFrame(t, ch)
+
+			// The backlog is full, the third message is dropped or waits for the room
+			published := publish("3")
+			select {
+			case err := <-published:
+				if policy == SlowConsumerBlock {
+					t.Error("publisher not held up by the full backlog:", err)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if policy == SlowConsumerDrop {
+					t.Fatal("publisher held up by the full backlog")
+				}
+			}
+			info, _ := reg.getSubsInfo(sess.sessionID, "backlog")
+			info.Lock()
+			if n := len(info.backlog); n != 1 {
+				t.Error("backlog:", n)
+			}
+			info.Unlock()
+
+			if err := reg.processAck(sess.sessionID, first.getHeader(HdrKeyAck)); err != nil {
+				t.Fatal(err)
+			}
+			if f := recvFrame(t, ch); string(f.body) != "2" {
+				t.Error(f)
+			}
+			if policy == SlowConsumerBlock {
+				if err := <-published; err != nil {
+					t.Error(err)
+				}
+				info.Lock()
+				if n := len(info.backlog); n != 1 || string(info.backlog[0].frame.body) != "3" {
+					t.Error("backlog:", n)
+				}
+				info.Unlock()
+			}
+		})
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{SlowConsumerDrop, SlowConsumerDisconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			reg := newTestRegistry()
+			reg.opts.OutboundQueueSize = 1
+			reg.opts.SlowConsumerPolicy = policy
+
+			// Nobody reads from the slow client
+			server, client := net.Pipe()
+			t.Cleanup(func() {
+				_ = server.Close()
+				_ = client.Close()
+			})
+			slow := newSession(server, reg, &sync.WaitGroup{})
+			fast, ch := newTestSession(t, reg)
+
+			dest := "/topic/slow-" + string(policy)
+			if err := reg.addSubscription(dest, "slow", HdrValAckAuto, "", 0, slow); err != nil {
+				t.Fatal(err)
+			}
+			if err := reg.addSubscription(dest, "fast", HdrValAckAuto, "", 0, fast); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 5; i++ {
+				published := make(chan error, 1)
+				go func() {
+					published <- reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, nil), "")
+				}()
+				select {
+				case err := <-published:
+					if err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("publisher held up by the slow consumer")
+				}
+				recvFrame(t, ch)
+			}
+
+			// Disconnected, the slow client reads up to the end of the connection
+			_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err := io.Copy(io.Discard, client)
+			if disconnected := err == nil; disconnected != (policy == SlowConsumerDisconnect) {
+				t.Error("disconnected:", disconnected, err)
+			}
+		})
+	}
+
+	t.Run(string(SlowConsumerBlock), func(t *testing.T) {
+		reg := newTestRegistry()
+		reg.opts.OutboundQueueSize = 1
+		reg.opts.SlowConsumerPolicy = SlowConsumerBlock
+
+		server, client := net.Pipe()
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		slow := newSession(server, reg, wg)
+		dest := "/queue/slow-" + string(SlowConsumerBlock)
+		if err := reg.addSubscription(dest, "slow", HdrValAckAuto, "", 0, slow); err != nil {
+			t.Fatal(err)
+		}
+
+		// The publisher waits for the room in the queue of the slow client
+		published := make(chan error, 1)
+		go func() {
+			for i := 0; i < 3; i++ {
+				if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, nil), ""); err != nil {
+					published <- err
+					return
+				}
+			}
+			published <- nil
+		}()
+		select {
+		case err := <-published:
+			t.Fatal("publisher not held up by the full queue:", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// The rest of the broker carries on meanwhile, the other publishers to the queue included
+		go func() { _ = reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, nil), "") }()
+		subscribed := make(chan error, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			subscribed <- reg.addSubscription("/topic/unrelated", "unrelated", HdrValAckAuto, "", 0, slow)
+		}()
+		select {
+		case err := <-subscribed:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("registry held up by the slow consumer")
+		}
+
+		// The client drops, the cleanup of its session releases the publisher
+		_ = client.Close()
+		cleanedUp := make(chan struct{})
+		go func() {
+			slow.cleanup()
+			close(cleanedUp)
+		}()
+		select {
+		case <-cleanedUp:
+		case <-time.After(5 * time.Second):
+			t.Fatal("session cleanup deadlocked with the blocked publisher")
+		}
+		select {
+		case err := <-published:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("publisher still held up by the closed session")
+		}
+	})
 }
@@ -1,6 +1,8 @@
 package stomp
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net"
 	"os"
@@ -12,18 +14,23 @@ import (
 type tcpBroker struct {
 	listener net.Listener
 	handler  func()
+	reg      *registry
 }
 
 // startTcpBroker is the entry point for starting a TCP server for STOMP broker
-func startTcpBroker(opts *BrokerOpts) (*tcpBroker, error) {
+func startTcpBroker(reg *registry) (*tcpBroker, error) {
 	var err error
-	tcp := &tcpBroker{}
+	opts := reg.opts
+	tcp := &tcpBroker{reg: reg}
 
 	// Listen for incoming connections.
 	tcp.listener, err = net.Listen("tcp", opts.Host+":"+opts.Port)
 	if err != nil {
 		return nil, errorMsg(errNetwork, "Listening failed: "+err.Error())
 	}
+	if opts.TLSConfig != nil {
+		tcp.listener = tls.NewListener(tcp.listener, opts.TLSConfig)
+	}
 
 	// Handle sigterm and await termChan signal
 	termChan := make(chan os.Signal, 2)
@@ -44,8 +51,7 @@ func startTcpBroker(opts *BrokerOpts) (*tcpBroker, error) {
 			}
 			// Handle connections in a new goroutine.
 			wgSessions.Add(1)
-			go NewSession(conn, opts.LoginFunc, wgSessions, opts.HeartbeatSendIntervalMsec,
-				opts.HeartbeatReceiveIntervalMsec).Start()
+			go newSession(conn, tcp.reg, wgSessions).Start()
 		}
 		wgSessions.Wait()
 	}
@@ -64,10 +70,16 @@ func (tcp *tcpBroker) Shutdown() {
 	_ = tcp.listener.Close()
 }
 
-func startTcpClient(host, port string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", host+":"+port)
+func startTcpClient(ctx context.Context, host, port string, tlsConfig *tls.Config) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", host+":"+port)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host+":"+port)
+	}
 	if err != nil {
-		return nil, errorMsg(errNetwork, "Connect failed: "+err.Error())
+		return nil, errorWrap(errNetwork, ErrDialFailed, err.Error())
 	}
 	return conn, nil
 }
@@ -0,0 +1,121 @@
+package stomp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCert issues the certificate for the name, signed by the parent. It is self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "stomp-ca", nil, x509.ExtKeyUsageAny)
+	serverCert := newTestCert(t, "localhost", &ca, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, "stomp-client", &ca, x509.ExtKeyUsageClientAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	tests := []struct {
+		transport Transport
+		port      string
+	}{
+		{TransportTCP, "61614"},
+		{TransportWebsocket, "9992"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.transport), func(t *testing.T) {
+			peers := make(chan string, 1)
+			broker, err := StartBroker(&BrokerOpts{
+				Transport: test.transport,
+				Port:      test.port,
+				TLSLoginFunc: func(login, passcode string, peerCert *x509.Certificate) error {
+					if peerCert == nil {
+						peers <- ""
+						return errorMsg(errInvalidArg, "missing client certificate")
+					}
+					peers <- peerCert.Subject.CommonName
+					return nil
+				},
+				TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{serverCert},
+					ClientAuth:   tls.RequireAndVerifyClientCert,
+					ClientCAs:    pool,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go broker.ListenAndServe()
+			defer broker.Shutdown()
+			time.Sleep(100 * time.Millisecond) // Let the websocket server start listening
+
+			c := NewClientHandler(test.transport, "localhost", test.port, &ClientOpts{
+				TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{clientCert},
+					RootCAs:      pool,
+				},
+			})
+			if _, err = c.Connect(false); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case peer := <-peers:
+				if peer != "stomp-client" {
+					t.Error("peer:", peer)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for login")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err = c.SendWithReceipt(ctx, "/topic/tls", []byte("secure"), "text/plain", nil); err != nil {
+				t.Error(err)
+			}
+			if err = c.Disconnect(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
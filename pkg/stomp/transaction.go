@@ -1,56 +1,205 @@
 package stomp
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+	"time"
+)
 
-// txBuffer stores the queued-up message-frames for the transactions
-// It is the mapping from the transaction ID to list of messages
-var txBuffer = map[string][]*Frame{}
+// transaction holds the frames of a transaction until it is committed
+type transaction struct {
+	frames  []*Frame    // SEND, ACK and NACK frames in the order received
+	expired bool        // Set once the transaction outlived the MaxTxLifetime, its frames dropped
+	timer   *time.Timer // Expires the transaction, nil without the MaxTxLifetime
+}
+
+// txKey identifies the transaction: its ID is unique only within the session that began it, no other session can
+// address it
+type txKey struct {
+	sessionID string
+	txID      string
+}
 
 // startTx begins the transaction by creating the buffer queue for the txID
-func startTx(txID string) error {
+func (r *registry) startTx(sessionID, txID string) error {
 	if txID == "" {
 		return errorMsg(errTransaction, "Missing transaction ID")
 	}
-	if _, ok := txBuffer[txID]; ok {
+	key := txKey{sessionID: sessionID, txID: txID}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.txBuffer[key]; ok {
 		return errorMsg(errTransaction, "Transaction already began/present (possible duplicate), TxID: "+txID)
 	}
-	txBuffer[txID] = []*Frame{}
+	tx := &transaction{}
+	if r.opts.MaxTxLifetime > 0 {
+		tx.timer = time.AfterFunc(r.opts.MaxTxLifetime, func() {
+			r.Lock()
+			defer r.Unlock()
+			log.Println("Transaction expired, dropping its frames, TxID:", txID)
+			tx.expired = true
+			tx.frames = nil
+		})
+	}
+	r.txBuffer[key] = tx
 	return nil
 }
 
-// bufferTxMessage adds the message to the transaction queue
-func bufferTxMessage(txID string, msgFrame *Frame) error {
-	if _, ok := txBuffer[txID]; !ok {
-		return errorMsg(errTransaction, "No such transaction present, TxID: "+txID)
+// getTx returns the transaction of the session. The caller must hold the lock.
+func (r *registry) getTx(sessionID, txID string) (*transaction, error) {
+	tx, ok := r.txBuffer[txKey{sessionID: sessionID, txID: txID}]
+	if !ok {
+		return nil, errorMsg(errTransaction, fmt.Sprintf("Transaction ID '%s' not found in txBuffer", txID))
+	}
+	if tx.expired {
+		return nil, errorMsg(errTransaction, "Transaction expired, TxID: "+txID)
+	}
+	return tx, nil
+}
+
+// bufferTxFrame adds the SEND, ACK or NACK frame to the transaction queue, it takes effect on commit
+func (r *registry) bufferTxFrame(sessionID, txID string, frame *Frame) error {
+	r.Lock()
+	defer r.Unlock()
+	tx, err := r.getTx(sessionID, txID)
+	if err != nil {
+		return err
+	}
+	if r.opts.MaxTxFrames > 0 && len(tx.frames) >= r.opts.MaxTxFrames {
+		return errorMsg(errTransaction,
+			fmt.Sprintf("Transaction exceeds MaxTxFrames (%d), TxID: %s", r.opts.MaxTxFrames, txID))
 	}
-	txBuffer[txID] = append(txBuffer[txID], msgFrame)
+	tx.frames = append(tx.frames, frame)
 	return nil
 }
 
-// foreachTx executes the closure on each message in the list for given transaction
-func foreachTx(txID string, fn func(*Frame) error) error {
+// txFrames returns a copy of the frames of the transaction, in their order. The transaction expired by then cannot
+// be committed.
+func (r *registry) txFrames(sessionID, txID string) ([]*Frame, error) {
 	if txID == "" {
-		return errorMsg(errTransaction, "Missing transaction ID when committing")
+		return nil, errorMsg(errTransaction, "Missing transaction ID when committing")
 	}
-	if _, ok := txBuffer[txID]; !ok {
-		return errorMsg(errTransaction, fmt.Sprintf("Transaction ID '%s' not found in txBuffer", txID))
+	r.Lock()
+	defer r.Unlock()
+	tx, err := r.getTx(sessionID, txID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]*Frame(nil), tx.frames...), nil
+}
+
+// commitTx applies the frames of the transaction in their order. The frames are checked and the messages persisted
+// to the message store in a single batch before any of them is delivered, so that either all or none of them are
+// kept. A frame failing after that, e.g. as a destination filled up meanwhile, does not hold up the others: its
+// message is deleted from the store and the first such error is returned.
+func (r *registry) commitTx(sessionID, txID string) error {
+	frames, err := r.txFrames(sessionID, txID)
+	if err != nil {
+		return err
 	}
-	for _, frame := range txBuffer[txID] {
-		if err := fn(frame); err != nil {
+
+	var stored []*Frame
+	for i, frame := range frames {
+		if frame.command != CmdSend {
+			continue
+		}
+		msg, err := r.prepareMessage(frame)
+		if err != nil {
 			return err
 		}
+		frames[i] = msg
+		if r.opts.MessageStore != nil && r.isQueue(msg.getHeader(HdrKeyDestination)) {
+			stored = append(stored, msg)
+		}
+	}
+	if err = r.checkTx(sessionID, frames); err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		if err = r.opts.MessageStore.AppendBatch(stored); err != nil {
+			return err
+		}
+	}
+
+	var firstErr error
+	for _, frame := range frames {
+		if frame.command == CmdSend {
+			err = r.deliverMessage(frame, txID)
+			if err != nil {
+				r.forgetStored(frame)
+			}
+		} else {
+			err = r.acknowledge(sessionID, frame)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err = r.dropTx(sessionID, txID); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// checkTx verifies that the frames of the transaction can be applied: the acknowledgements refer to the subscriptions
+// of the session, and the queue messages that no subscriber has room to receive fit the held messages of their
+// destinations.
+func (r *registry) checkTx(sessionID string, frames []*Frame) error {
+	r.Lock()
+	defer r.Unlock()
+
+	heldCount, heldBytes := map[string]int{}, map[string]int{}
+	for _, frame := range frames {
+		switch frame.command {
+		case CmdAck, CmdNack:
+			ackVal := frame.getHeader(HdrKeyID)
+			_, subsID, _, err := scanAckNum(ackVal)
+			if err != nil {
+				return err
+			}
+			if _, ok := r.subsToDestMap[subsKey{sessionID: sessionID, subsID: subsID}]; !ok {
+				return errorMsg(errBrokerStateMachine, "Missing entry in subsToDestMap, for key: "+subsID)
+			}
+
+		case CmdSend:
+			dest := frame.getHeader(HdrKeyDestination)
+			if !r.isQueue(dest) || hasRoom(r.matchSubs(dest, frame)) {
+				continue
+			}
+			if _, ok := heldCount[dest]; !ok {
+				heldCount[dest], heldBytes[dest] = len(r.heldFrames[dest]), r.heldBytes[dest]
+			}
+			heldCount[dest]++
+			heldBytes[dest] += len(frame.body)
+			if r.opts.MaxHeldBytes != 0 && len(frame.body) > r.opts.MaxHeldBytes {
+				return errorMsg(errBrokerStateMachine,
+					"Message larger than MaxHeldBytes, no subscribers to receive: "+dest)
+			}
+			if r.opts.OverflowPolicy == OverflowReject && (heldCount[dest] > r.opts.MaxHeldMessages ||
+				(r.opts.MaxHeldBytes != 0 && heldBytes[dest] > r.opts.MaxHeldBytes)) {
+				return errorMsg(errBrokerStateMachine, "Destination is full, no subscribers to receive: "+dest)
+			}
+		}
 	}
 	return nil
 }
 
-// dropTx removes the transaction messages from the txBuffer
-func dropTx(txID string) error {
+// dropTx removes the transaction frames from the txBuffer, once committed or aborted. The expired transaction is
+// dropped too.
+func (r *registry) dropTx(sessionID, txID string) error {
 	if txID == "" {
 		return errorMsg(errTransaction, "Missing transaction ID when cancelling")
 	}
-	if _, ok := txBuffer[txID]; !ok {
-		return errorMsg(errTransaction, fmt.Sprintf("Transaction ID '%s' not found for deletion from txBuffer", txID))
+	key := txKey{sessionID: sessionID, txID: txID}
+	r.Lock()
+	defer r.Unlock()
+	tx, ok := r.txBuffer[key]
+	if !ok {
+		return errorMsg(errTransaction, fmt.Sprintf("Transaction ID '%s' not found in txBuffer", txID))
+	}
+	if tx.timer != nil {
+		tx.timer.Stop()
 	}
-	delete(txBuffer, txID)
+	delete(r.txBuffer, key)
 	return nil
 }
@@ -1,107 +1,205 @@
 package stomp
 
 import (
-	"errors"
-	"fmt"
 	"testing"
+	"time"
 )
 
 func TestTx(t *testing.T) {
-	cleanupTx()
+	reg := newTestRegistry()
 
 	txID := "tx"
-	if err := startTx(txID); err != nil {
+	if err := reg.startTx("sess", txID); err != nil {
 		t.Error(err)
 	}
 
 	out := []string{"Hello", "World"}
-	if err := bufferTxMessage(txID, NewFrame(CmdMessage, nil, []byte(out[0]))); err != nil {
+	if err := reg.bufferTxFrame("sess", txID, NewFrame(CmdMessage, nil, []byte(out[0]))); err != nil {
 		t.Error(err)
 	}
 
-	if err := bufferTxMessage(txID, NewFrame(CmdMessage, nil, []byte(out[1]))); err != nil {
+	if err := reg.bufferTxFrame("sess", txID, NewFrame(CmdMessage, nil, []byte(out[1]))); err != nil {
 		t.Error(err)
 	}
 
-	m := 0
-	if err := foreachTx(txID, func(frame *Frame) error {
+	frames, err := reg.txFrames("sess", txID)
+	if err != nil || len(frames) != len(out) {
+		t.Error(frames, err)
+	}
+	for m, frame := range frames {
 		if out[m] != string(frame.body) {
-			return fmt.Errorf("expected: %s, got: %s", out[m], string(frame.body))
+			t.Errorf("expected: %s, got: %s", out[m], string(frame.body))
 		}
-		m++
-		return nil
-	}); err != nil {
-		t.Error(err)
 	}
 
-	if len(txBuffer) != 1 {
-		t.Error(txBuffer)
+	if len(reg.txBuffer) != 1 {
+		t.Error(reg.txBuffer)
 	}
 
-	if len(txBuffer[txID]) != 2 {
-		t.Error(txBuffer)
+	if len(reg.txBuffer[txKey{sessionID: "sess", txID: txID}].frames) != 2 {
+		t.Error(reg.txBuffer)
 	}
 
-	if err := dropTx(txID); err != nil {
+	if err := reg.dropTx("sess", txID); err != nil {
 		t.Error(err)
 	}
 
-	if len(txBuffer) != 0 {
-		t.Error(txBuffer)
+	if len(reg.txBuffer) != 0 {
+		t.Error(reg.txBuffer)
 	}
 }
 
 func TestTxErr(t *testing.T) {
-	cleanupTx()
+	reg := newTestRegistry()
 
-	if err := startTx(""); err == nil {
+	if err := reg.startTx("sess", ""); err == nil {
 		t.Error()
 	}
 
-	if err := startTx("tx"); err != nil {
+	if err := reg.startTx("sess", "tx"); err != nil {
 		t.Error()
 	}
 
-	if err := startTx("tx"); err == nil {
+	if err := reg.startTx("sess", "tx"); err == nil {
 		t.Error()
 	}
 
-	if err := bufferTxMessage("", nil); err == nil {
+	if err := reg.bufferTxFrame("sess", "", nil); err == nil {
 		t.Error()
 	}
 
-	if err := bufferTxMessage("tx", NewFrame(CmdMessage, nil, []byte("Hello"))); err != nil {
+	if err := reg.bufferTxFrame("sess", "tx", NewFrame(CmdMessage, nil, []byte("Hello"))); err != nil {
 		t.Error(err)
 	}
 
-	if err := foreachTx("tx", func(frame *Frame) error {
-		return errors.New("tx err")
-	}); err == nil {
+	if _, err := reg.txFrames("sess", ""); err == nil {
 		t.Error()
 	}
 
-	if err := foreachTx("", func(frame *Frame) error {
-		return nil
-	}); err == nil {
+	if _, err := reg.txFrames("sess", "tx100"); err == nil {
 		t.Error()
 	}
 
-	if err := foreachTx("tx100", func(frame *Frame) error {
-		return nil
-	}); err == nil {
+	// Another session cannot use the transaction
+	if err := reg.bufferTxFrame("other", "tx", NewFrame(CmdMessage, nil, []byte("Hello"))); err == nil {
+		t.Error()
+	}
+	if _, err := reg.txFrames("other", "tx"); err == nil {
+		t.Error()
+	}
+	if err := reg.dropTx("other", "tx"); err == nil {
 		t.Error()
 	}
 
-	if err := dropTx(""); err == nil {
+	if err := reg.dropTx("sess", ""); err == nil {
 		t.Error()
 	}
-	if err := dropTx("tx100"); err == nil {
+	if err := reg.dropTx("sess", "tx100"); err == nil {
 		t.Error()
 	}
 }
 
-func cleanupTx() {
-	for k := range txBuffer {
-		delete(txBuffer, k)
+func TestTxAck(t *testing.T) {
+	reg := newTestRegistry()
+	sess, ch := newTestSession(t, reg)
+	other, _ := newTestSession(t, reg)
+	defer func() { _ = reg.cleanupSubscriptions(sess.sessionID) }()
+
+	dest := "/queue/tx-ack"
+	if err := reg.addSubscription(dest, "tx-ack", HdrValAckClientIndividual, "", 0, sess); err != nil {
+		t.Fatal(err)
+	}
+	info, err := reg.getSubsInfo(sess.sessionID, "tx-ack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := func(sess *Session, cmd Command, h map[Header]string) error {
+		return sess.stateMachine(NewFrame(cmd, h, nil))
+	}
+	ackIn := func(txID string) error {
+		if err := reg.publish(NewFrame(CmdSend, map[Header]string{HdrKeyDestination: dest}, nil), ""); err != nil {
+			t.Fatal(err)
+		}
+		ackID := recvFrame(t, ch).getHeader(HdrKeyAck)
+		return control(sess, CmdAck, map[Header]string{HdrKeyID: ackID, HdrKeyTransaction: txID})
+	}
+
+	// The ACK takes effect on commit
+	if err = control(sess, CmdBegin, map[Header]string{HdrKeyTransaction: "tx-commit"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ackIn("tx-commit"); err != nil {
+		t.Fatal(err)
+	}
+	if n := info.pendingCount(); n != 1 {
+		t.Error("pending before commit:", n)
+	}
+	if err = control(other, CmdCommit, map[Header]string{HdrKeyTransaction: "tx-commit"}); err == nil {
+		t.Error("expected error committing the transaction of another session")
+	}
+	// The transaction IDs are per session
+	if err = control(other, CmdBegin, map[Header]string{HdrKeyTransaction: "tx-commit"}); err != nil {
+		t.Error(err)
+	}
+	if err = control(other, CmdAbort, map[Header]string{HdrKeyTransaction: "tx-commit"}); err != nil {
+		t.Error(err)
+	}
+	if err = control(sess, CmdCommit, map[Header]string{HdrKeyTransaction: "tx-commit"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := info.pendingCount(); n != 0 {
+		t.Error("pending after commit:", n)
+	}
+	if _, ok := reg.txBuffer[txKey{sessionID: sess.sessionID, txID: "tx-commit"}]; ok ||
+		sess.txIDs.Contains("tx-commit") {
+		t.Error("transaction kept after commit")
+	}
+
+	// The ACK is rolled back on abort
+	if err = control(sess, CmdBegin, map[Header]string{HdrKeyTransaction: "tx-abort"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ackIn("tx-abort"); err != nil {
+		t.Fatal(err)
+	}
+	if err = control(other, CmdAbort, map[Header]string{HdrKeyTransaction: "tx-abort"}); err == nil {
+		t.Error("expected error aborting the transaction of another session")
+	}
+	if err = control(sess, CmdAbort, map[Header]string{HdrKeyTransaction: "tx-abort"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := info.pendingCount(); n != 1 {
+		t.Error("pending after abort:", n)
+	}
+}
+
+func TestTxLimits(t *testing.T) {
+	reg := newTestRegistry()
+	reg.opts.MaxTxFrames = 2
+	reg.opts.MaxTxLifetime = 20 * time.Millisecond
+	frame := NewFrame(CmdSend, map[Header]string{HdrKeyDestination: "/queue/tx-limits"}, nil)
+
+	if err := reg.startTx("sess", "tx-frames"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := reg.bufferTxFrame("sess", "tx-frames", frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.bufferTxFrame("sess", "tx-frames", frame); err == nil {
+		t.Error("expected error exceeding MaxTxFrames")
+	}
+
+	// The expired transaction cannot be committed, only dropped
+	time.Sleep(50 * time.Millisecond)
+	if _, err := reg.txFrames("sess", "tx-frames"); err == nil {
+		t.Error("expected error committing the expired transaction")
+	}
+	if err := reg.dropTx("sess", "tx-frames"); err != nil {
+		t.Error(err)
+	}
+	if len(reg.txBuffer) != 0 {
+		t.Error(reg.txBuffer)
 	}
 }
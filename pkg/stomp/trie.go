@@ -0,0 +1,132 @@
+package stomp
+
+import "strings"
+
+// Wildcards in the subscription destinations. The destination is split into segments at '.' and '/'.
+const (
+	wildcardSegment    = "*" // Matches exactly one segment
+	wildcardOneOrMore  = ">" // Matches one or more trailing segments (ActiveMQ style)
+	wildcardZeroOrMore = "#" // Matches zero or more trailing segments (RabbitMQ style)
+)
+
+// splitDest splits the destination into its segments
+func splitDest(dest string) []string {
+	return strings.FieldsFunc(dest, func(r rune) bool {
+		return r == '.' || r == '/'
+	})
+}
+
+// isWildcardDest tells if the destination is a pattern containing any wildcard segment
+func isWildcardDest(dest string) bool {
+	for _, seg := range splitDest(dest) {
+		if seg == wildcardSegment || seg == wildcardOneOrMore || seg == wildcardZeroOrMore {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWildcardDest checks that the multi-segment wildcards appear only at the end of the pattern
+func validateWildcardDest(dest string) error {
+	segs := splitDest(dest)
+	for i, seg := range segs {
+		if (seg == wildcardOneOrMore || seg == wildcardZeroOrMore) && i != len(segs)-1 {
+			return errorMsg(errBrokerStateMachine, "Wildcard '"+seg+"' must be the last segment: "+dest)
+		}
+	}
+	return nil
+}
+
+// destMatches tells if the destination matches the wildcard pattern
+func destMatches(pattern, dest string) bool {
+	p, d := splitDest(pattern), splitDest(dest)
+	for i, seg := range p {
+		switch seg {
+		case wildcardZeroOrMore:
+			return true
+		case wildcardOneOrMore:
+			return len(d) > i
+		case wildcardSegment:
+			if i >= len(d) {
+				return false
+			}
+		default:
+			if i >= len(d) || d[i] != seg {
+				return false
+			}
+		}
+	}
+	return len(p) == len(d)
+}
+
+// destTrie indexes the wildcard patterns by their segments, so the patterns matching a destination are found
+// without comparing the destination against each one of them
+type destTrie struct {
+	children map[string]*destTrie // Segment => subtree
+	patterns map[string]struct{}  // Patterns ending at this node
+}
+
+func newDestTrie() *destTrie {
+	return &destTrie{
+		children: map[string]*destTrie{},
+		patterns: map[string]struct{}{},
+	}
+}
+
+// insert adds the pattern to the trie
+func (t *destTrie) insert(pattern string) {
+	node := t
+	for _, seg := range splitDest(pattern) {
+		child, ok := node.children[seg]
+		if !ok {
+			child = newDestTrie()
+			node.children[seg] = child
+		}
+		node = child
+	}
+	node.patterns[pattern] = struct{}{}
+}
+
+// remove deletes the pattern from the trie, pruning the branches left empty
+func (t *destTrie) remove(pattern string) {
+	t.removeSegs(pattern, splitDest(pattern))
+}
+
+func (t *destTrie) removeSegs(pattern string, segs []string) bool {
+	if len(segs) == 0 {
+		delete(t.patterns, pattern)
+	} else if child, ok := t.children[segs[0]]; ok && child.removeSegs(pattern, segs[1:]) {
+		delete(t.children, segs[0])
+	}
+	return len(t.patterns) == 0 && len(t.children) == 0
+}
+
+// match calls fn on every pattern that matches the destination
+func (t *destTrie) match(dest string, fn func(pattern string)) {
+	t.matchSegs(splitDest(dest), fn)
+}
+
+func (t *destTrie) matchSegs(segs []string, fn func(pattern string)) {
+	if child, ok := t.children[wildcardZeroOrMore]; ok {
+		child.each(fn)
+	}
+	if len(segs) == 0 {
+		t.each(fn)
+		return
+	}
+	if child, ok := t.children[wildcardOneOrMore]; ok {
+		child.each(fn)
+	}
+	if child, ok := t.children[wildcardSegment]; ok {
+		child.matchSegs(segs[1:], fn)
+	}
+	if child, ok := t.children[segs[0]]; ok {
+		child.matchSegs(segs[1:], fn)
+	}
+}
+
+func (t *destTrie) each(fn func(pattern string)) {
+	for pattern := range t.patterns {
+		fn(pattern)
+	}
+}
@@ -0,0 +1,74 @@
+package stomp
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var wildcardMatches = []struct {
+	pattern string
+	dest    string
+	match   bool
+}{
+	{"/topic/orders.*", "/topic/orders.new", true},
+	{"/topic/orders.*", "/topic/orders", false},
+	{"/topic/orders.*", "/topic/orders.eu.new", false},
+	{"/topic/*.new", "/topic/orders.new", true},
+	{"/topic/orders.>", "/topic/orders.eu.new", true},
+	{"/topic/orders.>", "/topic/orders", false},
+	{"/topic/orders.#", "/topic/orders", true},
+	{"/topic/orders.#", "/topic/orders.eu.new", true},
+	{"/topic/orders/*", "/topic/orders/eu", true},
+	{"/topic/#", "/queue/orders", false},
+	{"/topic/orders", "/topic/orders", true},
+}
+
+func Test_destMatches(t *testing.T) {
+	for _, tc := range wildcardMatches {
+		if got := destMatches(tc.pattern, tc.dest); got != tc.match {
+			t.Error(tc.pattern, tc.dest, got)
+		}
+	}
+}
+
+func TestDestTrie(t *testing.T) {
+	trie := newDestTrie()
+	for _, tc := range wildcardMatches {
+		trie.insert(tc.pattern)
+	}
+
+	for _, tc := range wildcardMatches {
+		var got []string
+		trie.match(tc.dest, func(pattern string) { got = append(got, pattern) })
+		sort.Strings(got)
+
+		var want []string
+		for _, p := range wildcardMatches {
+			if destMatches(p.pattern, tc.dest) && (len(want) == 0 || want[len(want)-1] != p.pattern) {
+				want = append(want, p.pattern)
+			}
+		}
+		sort.Strings(want)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Error(tc.dest, diff)
+		}
+	}
+
+	for _, tc := range wildcardMatches {
+		trie.remove(tc.pattern)
+	}
+	if len(trie.children) != 0 {
+		t.Error("trie not pruned:", trie.children)
+	}
+}
+
+func Test_validateWildcardDest(t *testing.T) {
+	if err := validateWildcardDest("/topic/orders.>"); err != nil {
+		t.Error(err)
+	}
+	if err := validateWildcardDest("/topic/#.new"); err == nil {
+		t.Error("expected error for '#' in the middle")
+	}
+}
@@ -2,6 +2,7 @@ package stomp
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
@@ -15,11 +16,13 @@ import (
 
 type wssBroker struct {
 	httpServer *http.Server
+	reg        *registry
 }
 
 // startWebsocketBroker is starts the STOMP broker on Websocket server
-func startWebsocketBroker(opts *BrokerOpts) (*wssBroker, error) {
-	wss := &wssBroker{}
+func startWebsocketBroker(reg *registry) (*wssBroker, error) {
+	opts := reg.opts
+	wss := &wssBroker{reg: reg}
 
 	broker := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		wgSessions := &sync.WaitGroup{}
@@ -35,15 +38,17 @@ func startWebsocketBroker(opts *BrokerOpts) (*wssBroker, error) {
 
 			conn := websocket.NetConn(context.Background(), c, websocket.MessageText)
 			wgSessions.Add(1)
-			go NewSession(conn, opts.LoginFunc, wgSessions, opts.HeartbeatSendIntervalMsec,
-				opts.HeartbeatReceiveIntervalMsec).Start()
+			sess := newSession(conn, wss.reg, wgSessions)
+			sess.tlsState = r.TLS
+			go sess.Start()
 		}
 		wgSessions.Wait()
 	})
 
 	wss.httpServer = &http.Server{
-		Addr:    opts.Host + ":" + opts.Port,
-		Handler: broker,
+		Addr:      opts.Host + ":" + opts.Port,
+		Handler:   broker,
+		TLSConfig: opts.TLSConfig,
 	}
 
 	// Handle sigterm and await termChan signal
@@ -59,7 +64,14 @@ func startWebsocketBroker(opts *BrokerOpts) (*wssBroker, error) {
 
 // ListenAndServe accepts the websocket client connections and servers the STOMP requests
 func (wss *wssBroker) ListenAndServe() {
-	if err := wss.httpServer.ListenAndServe(); err != nil {
+	var err error
+	if wss.httpServer.TLSConfig != nil {
+		// The certificates come from the TLSConfig
+		err = wss.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = wss.httpServer.ListenAndServe()
+	}
+	if err != nil {
 		log.Println(err)
 		return
 	}
@@ -73,14 +85,23 @@ func (wss *wssBroker) Shutdown() {
 	}
 }
 
-func startWebsocketClient(host, port string) (net.Conn, error) {
-	c, _, err := websocket.Dial(context.Background(), "ws://"+host+":"+port,
-		&websocket.DialOptions{
-			Subprotocols: []string{"v12.stomp"},
-		})
+func startWebsocketClient(ctx context.Context, host, port string, tlsConfig *tls.Config) (net.Conn, error) {
+	url := "ws://" + host + ":" + port
+	dialOpts := &websocket.DialOptions{
+		Subprotocols: []string{"v12.stomp"},
+	}
+	if tlsConfig != nil {
+		url = "wss://" + host + ":" + port
+		dialOpts.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+
+	c, _, err := websocket.Dial(ctx, url, dialOpts)
 	if err != nil {
-		return nil, err
+		return nil, errorWrap(errNetwork, ErrDialFailed, err.Error())
 	}
 
+	// The connection outlives the ctx for dialing
 	return websocket.NetConn(context.Background(), c, websocket.MessageText), nil
 }